@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var assembleCommand = &cli.Command{
+	Usage: "assemble [-k type] [-w filter] [-e with-incomplete] [-q quiet] [-o file] [-strict] <file...>",
+	Short: "reassemble segmented packets found in RT file(s)",
+	Run:   runAssemble,
+}
+
+func runAssemble(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	all := cmd.Flag.Bool("e", false, "include incomplete groups")
+	quiet := cmd.Flag.Bool("q", false, "quiet")
+	file := cmd.Flag.String("o", "", "output file")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	var w io.WriteCloser
+	if *file != "" {
+		wc, err := CreateFile(*file)
+		if err != nil {
+			return err
+		}
+		defer wc.Close()
+		w = wc
+	}
+	const row = "%4d | %6d | %6d | %6d | %6d | %10d | %s | %s"
+
+	var (
+		count      int
+		incomplete int
+		rejected   int
+		size       uint64
+		now        = time.Now()
+		asm        = NewAssembler()
+	)
+	emit := func(gs []*Group) error {
+		for _, g := range gs {
+			count++
+			if !g.Complete() {
+				incomplete++
+			}
+			if !*quiet {
+				log.Printf(row, g.Apid, g.First, g.Last, g.Segments, g.Missing, len(g.Data), g.When.Format(TimeFormat), g.Status())
+			}
+			if w == nil || (!g.Complete() && !*all) {
+				continue
+			}
+			bs, err := g.Bytes()
+			if err != nil {
+				rejected++
+				log.Printf("error: apid %d: group %d-%d: %s (%d bytes)", g.Apid, g.First, g.Last, err, len(g.Data))
+				if errs.Strict {
+					return err
+				}
+				continue
+			}
+			if _, err := w.Write(bs); err != nil {
+				return err
+			}
+			size += uint64(len(bs))
+		}
+		return nil
+	}
+	for p := range WalkTraced(cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle) {
+		gs, err := asm.Push(p.Packet)
+		if err != nil {
+			return err
+		}
+		if err := emit(gs); err != nil {
+			return err
+		}
+	}
+	if err := emit(asm.Flush()); err != nil {
+		return err
+	}
+	if w != nil {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("%d groups assembled, %d incomplete, %d rejected (%dMB, %s)", count, incomplete, rejected, size>>20, time.Since(now))
+	errs.Summary()
+	return errs.Err()
+}
+
+type Group struct {
+	Apid     int
+	First    int
+	Last     int
+	Segments int
+	Missing  int
+	Head     bool
+	Tail     bool
+	When     time.Time
+	Data     []byte
+
+	prefix []byte
+	offset int
+}
+
+func (g *Group) Complete() bool {
+	return g.Head && g.Tail && g.Missing == 0
+}
+
+func (g *Group) Status() string {
+	switch {
+	case !g.Head:
+		return "missing first segment"
+	case !g.Tail:
+		return "missing last segment"
+	case g.Missing > 0:
+		return "missing segments"
+	case g.Oversized():
+		return "too large"
+	default:
+		return "complete"
+	}
+}
+
+// Oversized reports whether the reassembled packet is larger than what the
+// length field of its CCSDS header can hold.
+func (g *Group) Oversized() bool {
+	return g.length() > 0xFFFF
+}
+
+func (g *Group) length() int {
+	return len(g.prefix) + len(g.Data) - g.offset - CCSDSHeaderLen - 1
+}
+
+// Bytes gives the reassembled packet as a RT record: the envelope and headers
+// of the first segment received followed by the user data of all segments.
+// The CCSDS header is marked as standalone. Groups too large to be held by a
+// single packet are rejected.
+func (g *Group) Bytes() ([]byte, error) {
+	if g.Oversized() {
+		return nil, ErrTooLarge
+	}
+	bs := make([]byte, len(g.prefix)+len(g.Data))
+	copy(bs, g.prefix)
+	copy(bs[len(g.prefix):], g.Data)
+
+	binary.LittleEndian.PutUint32(bs, uint32(len(bs)-4))
+	binary.BigEndian.PutUint16(bs[g.offset+2:], uint16(GroupStandalone)<<14|uint16(g.First&0x3FFF))
+	binary.BigEndian.PutUint16(bs[g.offset+4:], uint16(g.length()))
+	return bs, nil
+}
+
+func (g *Group) add(s *segment) {
+	g.Missing += (s.sequence - g.Last - 1) & 0x3FFF
+	g.Last = s.sequence
+	g.Segments++
+	g.Data = append(g.Data, s.data...)
+	if g.When.IsZero() {
+		g.When = s.when
+	}
+}
+
+type segment struct {
+	apid     int
+	grouping Grouping
+	sequence int
+	when     time.Time
+	offset   int
+	head     []byte
+	data     []byte
+}
+
+func segmentOf(p Packet) (*segment, bool) {
+	var (
+		c      *CCSDSHeader
+		offset int
+		bs     = p.Bytes()
+		s      segment
+	)
+	switch p := p.(type) {
+	case *TMPacket:
+		c, offset = p.CCSDS, PTHHeaderLen
+	case *CCSDSPacket:
+		c, offset = p.CCSDS, 4
+	default:
+		return nil, false
+	}
+	s.apid, s.grouping, s.sequence = c.Apid(), c.Grouping(), c.Sequence()
+	s.offset = offset
+
+	offset += CCSDSHeaderLen
+	if c.Secondary() {
+		offset += ESAHeaderLen
+		s.when = p.Timestamp()
+	}
+	if offset > len(bs) {
+		offset = len(bs)
+	}
+	s.head, s.data = bs[:offset], bs[offset:]
+	return &s, true
+}
+
+type Assembler struct {
+	groups map[int]*Group
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{groups: make(map[int]*Group)}
+}
+
+func (a *Assembler) Push(p Packet) ([]*Group, error) {
+	s, ok := segmentOf(p)
+	if !ok {
+		return nil, fmt.Errorf("assemble: %T packets have no segmentation", p)
+	}
+	var (
+		gs []*Group
+		g  = a.groups[s.apid]
+	)
+	switch s.grouping {
+	case GroupStandalone, GroupFirst:
+		if g != nil {
+			gs = append(gs, g)
+			delete(a.groups, s.apid)
+		}
+		g = newGroup(s)
+		g.Head = true
+		if s.grouping == GroupStandalone {
+			g.Tail = true
+			return append(gs, g), nil
+		}
+		a.groups[s.apid] = g
+	case GroupContinuation, GroupLast:
+		if g == nil {
+			g = newGroup(s)
+			a.groups[s.apid] = g
+		} else {
+			g.add(s)
+		}
+		if s.grouping == GroupLast {
+			g.Tail = true
+			gs = append(gs, g)
+			delete(a.groups, s.apid)
+		}
+	}
+	return gs, nil
+}
+
+func (a *Assembler) Flush() []*Group {
+	gs := make([]*Group, 0, len(a.groups))
+	for _, g := range a.groups {
+		gs = append(gs, g)
+	}
+	sort.Slice(gs, func(i, j int) bool {
+		return gs[i].Apid < gs[j].Apid
+	})
+	a.groups = make(map[int]*Group)
+	return gs
+}
+
+func newGroup(s *segment) *Group {
+	g := Group{
+		Apid:     s.apid,
+		First:    s.sequence,
+		Last:     s.sequence,
+		Segments: 1,
+		When:     s.when,
+		Data:     append([]byte(nil), s.data...),
+		prefix:   append([]byte(nil), s.head...),
+		offset:   s.offset,
+	}
+	return &g
+}
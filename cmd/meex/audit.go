@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+	"github.com/midbel/xxh"
+)
+
+var auditCommand = &cli.Command{
+	Usage: "audit [-k type] [-fix] <archive...>",
+	Short: "check that packets are stored in the right location of RT archive(s)",
+	Run:   runAudit,
+}
+
+const (
+	AuditMisplaced = "misplaced"
+	AuditUnsorted  = "unsorted"
+	AuditEmpty     = "empty"
+	AuditTruncated = "truncated"
+	AuditOverlap   = "overlap"
+	AuditDuplicate = "duplicate"
+	AuditLayout    = "layout"
+	AuditInvalid   = "invalid"
+)
+
+type Issue struct {
+	File   string
+	Reason string
+	Detail string
+}
+
+type auditFile struct {
+	File  string
+	Root  string
+	Size  int64
+	Sum   uint64
+	Count int
+
+	Starts time.Time
+	Ends   time.Time
+
+	Window    time.Time
+	First     time.Time
+	Last      time.Time
+	Misplaced int
+	Unsorted  int
+	Invalid   int
+	Trailing  int
+}
+
+func (a *auditFile) NeedFix() bool {
+	if a.Invalid > 0 {
+		return false
+	}
+	if a.Starts.IsZero() {
+		return false
+	}
+	return a.Size == 0 || a.Misplaced > 0 || a.Unsorted > 0 || a.Trailing > 0 || a.Window.IsZero()
+}
+
+func runAudit(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	fix := cmd.Flag.Bool("fix", false, "redistribute packets of inconsistent files")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	const row = "%-64s | %-10s | %s"
+
+	var (
+		files  []*auditFile
+		issues []Issue
+		now    = time.Now()
+	)
+	for _, a := range cmd.Flag.Args() {
+		err := filepath.Walk(a, func(p string, i os.FileInfo, err error) error {
+			if err != nil || i.IsDir() {
+				return err
+			}
+			f, err := auditRTFile(p, kind.Decod)
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		issues = append(issues, f.Issues()...)
+	}
+	issues = append(issues, auditOverlaps(files)...)
+	issues = append(issues, auditDuplicates(files)...)
+
+	for _, i := range issues {
+		log.Printf(row, i.File, i.Reason, i.Detail)
+	}
+	log.Printf("%d issues found in %d files (%s)", len(issues), len(files), time.Since(now))
+	if !*fix {
+		return nil
+	}
+
+	var fixed int
+	for _, f := range files {
+		if !f.NeedFix() {
+			continue
+		}
+		if err := fixRTFile(f, kind); err != nil {
+			return err
+		}
+		fixed++
+	}
+	log.Printf("%d files redistributed", fixed)
+	return nil
+}
+
+type countWriter int64
+
+func (c *countWriter) Write(bs []byte) (int, error) {
+	*c += countWriter(len(bs))
+	return len(bs), nil
+}
+
+func auditRTFile(file string, d Decoder) (*auditFile, error) {
+	r, err := OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	a := auditFile{
+		File: file,
+		Root: filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(file)))),
+	}
+	a.Window, a.Starts, a.Ends = parseTimePath(file)
+
+	var (
+		digest = xxh.New64(0)
+		size   countWriter
+		read   int64
+		prev   time.Time
+		delta  = GPS.Sub(UNIX)
+	)
+	s := Scan(io.TeeReader(r, io.MultiWriter(digest, &size)))
+	for s.Scan() {
+		bs := s.Bytes()
+		read += int64(len(bs))
+		a.Count++
+
+		p, err := d.Decode(bs)
+		if err != nil {
+			a.Invalid++
+			continue
+		}
+		t := p.Timestamp().Add(delta)
+		if a.First.IsZero() || t.Before(a.First) {
+			a.First = t
+		}
+		if t.After(a.Last) {
+			a.Last = t
+		}
+		if !prev.IsZero() && t.Before(prev) {
+			a.Unsorted++
+		}
+		prev = t
+		if !a.Window.IsZero() && !t.Truncate(Five).Equal(a.Window) {
+			a.Misplaced++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	a.Size = int64(size)
+	a.Trailing = int(a.Size - read)
+	a.Sum = digest.Sum64()
+	return &a, nil
+}
+
+func (a *auditFile) Issues() []Issue {
+	var is []Issue
+	if a.Size == 0 {
+		return append(is, Issue{File: a.File, Reason: AuditEmpty, Detail: "no packets"})
+	}
+	if a.Window.IsZero() {
+		is = append(is, Issue{File: a.File, Reason: AuditLayout, Detail: "path does not follow YYYY/DOY/HH/rt_MM_MM.dat"})
+	}
+	if a.Trailing > 0 {
+		d := fmt.Sprintf("%d trailing bytes after %d packets", a.Trailing, a.Count)
+		is = append(is, Issue{File: a.File, Reason: AuditTruncated, Detail: d})
+	}
+	if a.Invalid > 0 {
+		d := fmt.Sprintf("%d/%d packets can not be decoded", a.Invalid, a.Count)
+		is = append(is, Issue{File: a.File, Reason: AuditInvalid, Detail: d})
+	}
+	if a.Misplaced > 0 {
+		d := fmt.Sprintf("%d/%d packets outside %s (%s - %s)", a.Misplaced, a.Count, a.Window.Format(TimeFormat), a.First.Format(TimeFormat), a.Last.Format(TimeFormat))
+		is = append(is, Issue{File: a.File, Reason: AuditMisplaced, Detail: d})
+	}
+	if a.Unsorted > 0 {
+		d := fmt.Sprintf("%d/%d packets out of order", a.Unsorted, a.Count)
+		is = append(is, Issue{File: a.File, Reason: AuditUnsorted, Detail: d})
+	}
+	return is
+}
+
+func auditOverlaps(files []*auditFile) []Issue {
+	var (
+		is []Issue
+		ds = make(map[string][]*auditFile)
+	)
+	for _, f := range files {
+		if f.Starts.IsZero() {
+			continue
+		}
+		dir := filepath.Dir(f.File)
+		ds[dir] = append(ds[dir], f)
+	}
+	for _, fs := range ds {
+		sort.Slice(fs, func(i, j int) bool {
+			return fs[i].Starts.Before(fs[j].Starts)
+		})
+		for i := 1; i < len(fs); i++ {
+			prev, curr := fs[i-1], fs[i]
+			if curr.Starts.Before(prev.Ends) {
+				d := fmt.Sprintf("overlaps %s", filepath.Base(prev.File))
+				is = append(is, Issue{File: curr.File, Reason: AuditOverlap, Detail: d})
+			}
+		}
+	}
+	return is
+}
+
+func auditDuplicates(files []*auditFile) []Issue {
+	var (
+		is []Issue
+		ss = make(map[uint64]*auditFile)
+	)
+	for _, f := range files {
+		if f.Size == 0 {
+			continue
+		}
+		if o, ok := ss[f.Sum]; ok && o.Size == f.Size {
+			d := fmt.Sprintf("same content as %s", o.File)
+			is = append(is, Issue{File: f.File, Reason: AuditDuplicate, Detail: d})
+			continue
+		}
+		ss[f.Sum] = f
+	}
+	return is
+}
+
+func parseTimePath(file string) (time.Time, time.Time, time.Time) {
+	var zero time.Time
+
+	ps := strings.Split(filepath.ToSlash(filepath.Clean(TrimCompressExt(file))), "/")
+	if len(ps) < 4 {
+		return zero, zero, zero
+	}
+	ps = ps[len(ps)-4:]
+
+	year, err := strconv.Atoi(ps[0])
+	if err != nil || len(ps[0]) != 4 {
+		return zero, zero, zero
+	}
+	doy, err := strconv.Atoi(ps[1])
+	if err != nil || len(ps[1]) != 3 || doy < 1 || doy > 366 {
+		return zero, zero, zero
+	}
+	hour, err := strconv.Atoi(ps[2])
+	if err != nil || len(ps[2]) != 2 || hour > 23 {
+		return zero, zero, zero
+	}
+	var from, to int
+	if n, err := fmt.Sscanf(ps[3], RT, &from, &to); err != nil || n != 2 || from > to || to > 59 {
+		return zero, zero, zero
+	}
+	base := time.Date(year, 1, doy, hour, 0, 0, 0, time.UTC)
+	starts := base.Add(time.Duration(from) * time.Minute)
+	ends := base.Add(time.Duration(to+1) * time.Minute)
+
+	if fmt.Sprintf(RT, from, to) != ps[3] || from%5 != 0 || to != from+4 {
+		return zero, starts, ends
+	}
+	return starts, starts, ends
+}
+
+func fixRTFile(a *auditFile, kind Kind) error {
+	r, err := OpenFile(a.File)
+	if err != nil {
+		return err
+	}
+	var (
+		ps   []Packet
+		size countWriter
+		read int64
+	)
+	s := Scan(io.TeeReader(r, &size))
+	for s.Scan() {
+		read += int64(len(s.Bytes()))
+		p, err := kind.Decod.Decode(s.Bytes())
+		if err != nil {
+			r.Close()
+			return fmt.Errorf("%s: %s", a.File, err)
+		}
+		ps = append(ps, p)
+	}
+	r.Close()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	dir, base := filepath.Split(a.File)
+	backup := filepath.Join(dir, "."+base+".audit")
+	if err := os.Rename(a.File, backup); err != nil {
+		return err
+	}
+	ds, err := NewDispatcher(a.Root, "", kind, DefaultOpenFiles, Compress(CompressExt(a.File)))
+	if err == nil {
+		for _, p := range ps {
+			if err = ds.Dispatch(p); err != nil {
+				break
+			}
+		}
+		if e := ds.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		os.Rename(backup, a.File)
+		return err
+	}
+	if trailing := int64(size) - read; trailing > 0 {
+		// the bytes after the last packet are only kept in the backup.
+		log.Printf("%s: %d trailing bytes kept in %s", a.File, trailing, backup)
+		return nil
+	}
+	return os.Remove(backup)
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"time"
+
+	"github.com/midbel/linewriter"
+	"github.com/midbel/xxh"
+)
+
+const (
+	IdleApid     = 0x7FF
+	NoPacketHead = 0x7FF
+	IdleData     = 0x7FE
+	AOSIdleVC    = 0x3F
+	maxFrameLen  = 2048
+)
+
+var ASM = []byte{0x1a, 0xcf, 0xfc, 0x1d}
+
+type CCSDSPacket struct {
+	CCSDS   *CCSDSHeader
+	ESA     *ESAHeader
+	Payload []byte
+
+	kind string
+}
+
+type ccsdsDecoder struct {
+	kind    string
+	unframe func(io.Reader) io.Reader
+}
+
+func DecodeCCSDS() Decoder {
+	return ccsdsDecoder{kind: "ccsds"}
+}
+
+func DecodeSpacePackets() Decoder {
+	return ccsdsDecoder{kind: "spp", unframe: NewSpacePacketReader}
+}
+
+func DecodeCADU() Decoder {
+	return ccsdsDecoder{kind: "cadu", unframe: NewCADUReader}
+}
+
+func (d ccsdsDecoder) Unframe(r io.Reader) io.Reader {
+	if d.unframe == nil {
+		return r
+	}
+	return d.unframe(r)
+}
+
+func (d ccsdsDecoder) Decode(bs []byte) (Packet, error) {
+	if len(bs) < 4+CCSDSHeaderLen {
+		return nil, ErrShortBuffer
+	}
+	var c CCSDSHeader
+	if err := c.UnmarshalBinary(bs[4:]); err != nil {
+		return nil, err
+	}
+	p := CCSDSPacket{
+		CCSDS:   &c,
+		Payload: bs,
+		kind:    d.kind,
+	}
+	if c.Secondary() && len(bs) >= 4+CCSDSHeaderLen+ESAHeaderLen {
+		var e ESAHeader
+		if err := e.UnmarshalBinary(bs[4+CCSDSHeaderLen:]); err != nil {
+			return nil, err
+		}
+		p.ESA = &e
+	}
+	return &p, nil
+}
+
+// Kind gives the name of the kind of the stream the packet has been read
+// from.
+func (c *CCSDSPacket) Kind() string {
+	if c.kind == "" {
+		return "ccsds"
+	}
+	return c.kind
+}
+
+func (c *CCSDSPacket) Error() bool {
+	return c.CCSDS.Size() != len(c.Payload)-4
+}
+
+func (c *CCSDSPacket) PacketInfo() *Info {
+	return &Info{
+		Id:       c.CCSDS.Apid(),
+		Sequence: c.Sequence(),
+		Size:     len(c.Payload) - 4,
+		AcqTime:  c.Timestamp(),
+		Sum:      adler32.Checksum(c.Payload[4:]),
+		Context:  c.CCSDS.Grouping().String(),
+		Type:     "ccsds",
+	}
+}
+
+func (c *CCSDSPacket) Timestamp() time.Time {
+	if c.ESA == nil {
+		return time.Time{}
+	}
+	return c.ESA.Acquisition
+}
+
+// Reception gives the zero time: the reception time of the packets is not
+// available in the CCSDS headers.
+func (c *CCSDSPacket) Reception() time.Time {
+	return time.Time{}
+}
+
+func (c *CCSDSPacket) Id() (int, int) {
+	if c.ESA == nil {
+		return c.CCSDS.Apid(), 0
+	}
+	return c.CCSDS.Apid(), int(c.ESA.Source)
+}
+
+func (c *CCSDSPacket) Sequence() int {
+	return c.CCSDS.Sequence()
+}
+
+func (c *CCSDSPacket) Len() int {
+	return len(c.Payload)
+}
+
+func (c *CCSDSPacket) Less(p Packet) bool {
+	return c.Sequence() < p.Sequence()
+}
+
+func (c *CCSDSPacket) Diff(o Packet) *Gap {
+	if p, ok := o.(*CCSDSPacket); o == nil || !ok || c.CCSDS.Apid() != p.CCSDS.Apid() {
+		return nil
+	}
+	if o.Timestamp().After(c.Timestamp()) {
+		return o.Diff(c)
+	}
+	if delta := (c.Sequence() - o.Sequence()) & 0x3FFF; delta <= 1 {
+		return nil
+	}
+	return &Gap{
+		Id:     c.CCSDS.Apid(),
+		Starts: o.Timestamp(),
+		Ends:   c.Timestamp(),
+		First:  c.Sequence(),
+		Last:   o.Sequence(),
+	}
+}
+
+func (c *CCSDSPacket) Bytes() []byte {
+	return c.Payload
+}
+
+type spacePacketReader struct {
+	reader io.Reader
+	buffer []byte
+	offset int
+
+	start    int64
+	position int64
+}
+
+// NewSpacePacketReader reads a stream of bare space packets and gives them
+// back prefixed by their length, as they are stored in RT files.
+func NewSpacePacketReader(r io.Reader) io.Reader {
+	return &spacePacketReader{reader: r}
+}
+
+func (s *spacePacketReader) Read(bs []byte) (int, error) {
+	if s.offset >= len(s.buffer) {
+		var c CCSDSHeader
+		head := make([]byte, CCSDSHeaderLen)
+		if _, err := io.ReadFull(s.reader, head); err != nil {
+			return 0, err
+		}
+		if err := c.UnmarshalBinary(head); err != nil {
+			return 0, err
+		}
+		s.start = s.position
+
+		s.buffer, s.offset = make([]byte, 4+c.Size()), 0
+		binary.LittleEndian.PutUint32(s.buffer, uint32(c.Size()))
+		copy(s.buffer[4:], head)
+		n, err := io.ReadFull(s.reader, s.buffer[4+CCSDSHeaderLen:])
+		s.position += int64(CCSDSHeaderLen + n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(bs, s.buffer[s.offset:])
+	s.offset += n
+	return n, nil
+}
+
+func (s *spacePacketReader) Position() int64 {
+	if s.offset >= len(s.buffer) {
+		return s.position
+	}
+	return s.start
+}
+
+type virtualChannel struct {
+	count   int
+	synced  bool
+	partial []byte
+
+	// origin is the offset of the CADU carrying the first byte of partial
+	// and carry the number of bytes of partial coming from previous CADUs.
+	origin int64
+	carry  int
+}
+
+type caduReader struct {
+	reader *bufio.Reader
+	size   int
+
+	channels map[int]*virtualChannel
+
+	buffer []byte
+	offset int
+
+	// position is the number of bytes read from reader and frame the offset of
+	// the last CADU read. records holds the end of the packets in buffer and
+	// the offset of the CADU carrying their first byte.
+	position int64
+	frame    int64
+	records  []caduRecord
+}
+
+type caduRecord struct {
+	end    int
+	origin int64
+}
+
+// NewCADUReader extracts the space packets carried by the TM or AOS transfer
+// frames of a stream of CADUs. Frames are expected to be derandomized and
+// without Reed-Solomon check symbols. Their length is found from the distance
+// between two consecutive sync markers, and a trailing FECF is detected (and
+// dropped) by checking its CRC. Packets spanning frames of a virtual channel
+// are reassembled, and dropped when frames are missing. Packets are positioned
+// at the offset of the CADU carrying their first byte.
+func NewCADUReader(r io.Reader) io.Reader {
+	return &caduReader{
+		reader:   bufio.NewReaderSize(r, 4*maxFrameLen),
+		channels: make(map[int]*virtualChannel),
+	}
+}
+
+func (c *caduReader) Read(bs []byte) (int, error) {
+	for c.offset >= len(c.buffer) {
+		c.buffer, c.offset, c.records = c.buffer[:0], 0, c.records[:0]
+		frame, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		c.process(frame)
+	}
+	n := copy(bs, c.buffer[c.offset:])
+	c.offset += n
+	return n, nil
+}
+
+func (c *caduReader) Position() int64 {
+	for _, r := range c.records {
+		if c.offset < r.end {
+			return r.origin
+		}
+	}
+	return c.position
+}
+
+func (c *caduReader) next() ([]byte, error) {
+	if err := c.sync(); err != nil {
+		return nil, err
+	}
+	if c.size == 0 {
+		size, err := c.frameLength()
+		if err != nil {
+			return nil, err
+		}
+		c.size = size
+	}
+	frame := make([]byte, c.size)
+	n, err := io.ReadFull(c.reader, frame)
+	c.position += int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (c *caduReader) sync() error {
+	var marker uint32
+	for i := 0; ; i++ {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		c.position++
+		marker = marker<<8 | uint32(b)
+		if i >= 3 && marker == binary.BigEndian.Uint32(ASM) {
+			c.frame = c.position - int64(len(ASM))
+			return nil
+		}
+	}
+}
+
+func (c *caduReader) frameLength() (int, error) {
+	bs, err := c.reader.Peek(2*maxFrameLen + 2*len(ASM))
+	if len(bs) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	for i := 0; i < len(bs); {
+		j := bytes.Index(bs[i:], ASM)
+		if j < 0 {
+			break
+		}
+		size := i + j
+		if n := 2*size + len(ASM); n+len(ASM) > len(bs) || bytes.Equal(bs[n:n+len(ASM)], ASM) {
+			return size, nil
+		}
+		i = size + 1
+	}
+	if err == nil {
+		return 0, fmt.Errorf("cadu: frame length can not be found")
+	}
+	return len(bs), nil
+}
+
+func (c *caduReader) process(frame []byte) {
+	if len(frame) < 8 {
+		return
+	}
+	var (
+		vcid, count, modulo, fhp int
+		start, end               = 0, len(frame)
+	)
+	if crc16(frame[:len(frame)-2]) == binary.BigEndian.Uint16(frame[len(frame)-2:]) {
+		end -= 2
+	}
+	switch version := frame[0] >> 6; version {
+	case 0:
+		vcid = int(frame[1]>>1) & 0x7
+		count, modulo = int(frame[3]), 1<<8
+		if frame[1]&0x1 == 0x1 {
+			end -= 4
+		}
+		status := binary.BigEndian.Uint16(frame[4:])
+		fhp, start = int(status&0x7FF), 6
+		if status&0x8000 != 0 {
+			start += int(frame[6]&0x3F) + 1
+		}
+	case 1:
+		vcid = int(frame[1] & 0x3F)
+		if vcid == AOSIdleVC {
+			return
+		}
+		count, modulo = int(frame[2])<<16|int(frame[3])<<8|int(frame[4]), 1<<24
+		fhp, start = int(binary.BigEndian.Uint16(frame[6:])&0x7FF), 8
+	default:
+		return
+	}
+	if start >= end {
+		return
+	}
+	vc, ok := c.channels[vcid]
+	if !ok {
+		vc = &virtualChannel{count: count}
+		c.channels[vcid] = vc
+	} else if (vc.count+1)%modulo != count {
+		vc.synced, vc.partial = false, nil
+	}
+	vc.count = count
+	c.packetZone(vc, frame[start:end], fhp)
+}
+
+func (c *caduReader) packetZone(vc *virtualChannel, zone []byte, fhp int) {
+	switch {
+	case fhp == IdleData:
+		return
+	case fhp == NoPacketHead:
+		if vc.synced {
+			vc.carry = len(vc.partial)
+			vc.partial = append(vc.partial, zone...)
+			c.extract(vc)
+		}
+		return
+	case fhp >= len(zone):
+		vc.synced, vc.partial = false, nil
+		return
+	}
+	if vc.synced {
+		vc.carry = len(vc.partial)
+		vc.partial = append(vc.partial, zone[:fhp]...)
+		c.extract(vc)
+	}
+	vc.synced, vc.partial = true, append([]byte(nil), zone[fhp:]...)
+	vc.origin, vc.carry = c.frame, 0
+	c.extract(vc)
+}
+
+func (c *caduReader) extract(vc *virtualChannel) {
+	for len(vc.partial) >= CCSDSHeaderLen {
+		size := CCSDSHeaderLen + int(binary.BigEndian.Uint16(vc.partial[4:])) + 1
+		if len(vc.partial) < size {
+			return
+		}
+		if apid := int(binary.BigEndian.Uint16(vc.partial) & 0x7FF); apid != IdleApid {
+			var prefix [4]byte
+			binary.LittleEndian.PutUint32(prefix[:], uint32(size))
+			c.buffer = append(c.buffer, prefix[:]...)
+			c.buffer = append(c.buffer, vc.partial[:size]...)
+			c.records = append(c.records, caduRecord{end: len(c.buffer), origin: vc.origin})
+		}
+		vc.partial = vc.partial[size:]
+		if vc.carry -= size; vc.carry <= 0 {
+			vc.origin, vc.carry = c.frame, 0
+		}
+	}
+}
+
+func crc16(bs []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range bs {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func storeCCSDS(bs []byte) ([]byte, error) {
+	vs := make([]byte, len(bs)+4)
+	binary.LittleEndian.PutUint32(vs, uint32(len(bs)))
+
+	copy(vs[4:], bs)
+	return vs, nil
+}
+
+func printCCSDSPacket(line *linewriter.Writer, p *CCSDSPacket, g *Gap, delta time.Duration) bool {
+	var diff int
+	if g != nil {
+		diff = g.Missing()
+	}
+	var ts time.Time
+	if t := p.Timestamp(); !t.IsZero() {
+		ts = t.Add(delta)
+	}
+	bad := "-"
+	if p.Error() {
+		bad = Bad
+	}
+	secondary := "no"
+	if p.CCSDS.Secondary() {
+		secondary = "yes"
+	}
+	line.AppendUint(uint64(p.Sequence()), 9, linewriter.AlignRight)
+	line.AppendUint(uint64(diff), 4, linewriter.AlignRight)
+	line.AppendUint(uint64(p.Len()), 4, linewriter.AlignRight)
+	line.AppendUint(uint64(p.CCSDS.Apid()), 4, linewriter.AlignRight)
+	line.AppendUint(uint64(p.CCSDS.PacketVersion()), 1, linewriter.AlignRight)
+	line.AppendUint(uint64(p.CCSDS.PacketType()), 1, linewriter.AlignRight)
+	line.AppendString(secondary, 3, linewriter.AlignRight)
+	line.AppendString(p.CCSDS.Grouping().String(), 12, linewriter.AlignRight)
+	line.AppendTime(ts, TimeFormat, linewriter.AlignRight)
+	line.AppendString(bad, 8, linewriter.AlignRight)
+	line.AppendUint(xxh.Sum64(p.Bytes(), 0), 16, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
+
+	return true
+}
+
+func init() {
+	printFunc := func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) bool {
+		v, ok := p.(*CCSDSPacket)
+		return ok && printCCSDSPacket(line, v, g, delta)
+	}
+	key := func(p Packet) (string, bool) {
+		v, ok := p.(*CCSDSPacket)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprint(v.CCSDS.Apid()), true
+	}
+	RegisterKind(Kind{
+		Name:   "ccsds",
+		Decod:  DecodeCCSDS(),
+		Sort:   SortTMIndex,
+		Header: 4 + CCSDSHeaderLen,
+		Frame:  storeCCSDS,
+		Print:  printFunc,
+		Key:    key,
+	})
+	RegisterKind(Kind{
+		Name:    "spp",
+		Aliases: []string{"space-packet"},
+		Decod:   DecodeSpacePackets(),
+		Sort:    SortTMIndex,
+		Header:  4 + CCSDSHeaderLen,
+		Print:   printFunc,
+		Key:     key,
+	})
+	RegisterKind(Kind{
+		Name:    "cadu",
+		Aliases: []string{"aos", "frame"},
+		Decod:   DecodeCADU(),
+		Sort:    SortTMIndex,
+		Header:  4 + CCSDSHeaderLen,
+		Print:   printFunc,
+		Key:     key,
+	})
+}
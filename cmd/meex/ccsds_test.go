@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testdata/sample.spp holds eight bare space packets. testdata/sample.cadu
+// holds the same packets in AOS transfer frames (VC 5, 100 bytes of data
+// zone, FECF) preceded by two bytes of garbage.
+func TestDecodeCCSDSSamples(t *testing.T) {
+	type packet struct {
+		Apid     int
+		Sequence int
+		Size     int
+		Offset   int64
+	}
+	data := []struct {
+		File    string
+		Decoder Decoder
+		Want    []packet
+	}{
+		{
+			File:    "sample.spp",
+			Decoder: DecodeSpacePackets(),
+			Want: []packet{
+				{Apid: 100, Sequence: 0, Size: 36, Offset: 0},
+				{Apid: 101, Sequence: 1, Size: 43, Offset: 36},
+				{Apid: 102, Sequence: 2, Size: 50, Offset: 79},
+				{Apid: 100, Sequence: 3, Size: 57, Offset: 129},
+				{Apid: 101, Sequence: 4, Size: 64, Offset: 186},
+				{Apid: 102, Sequence: 5, Size: 71, Offset: 250},
+				{Apid: 100, Sequence: 6, Size: 78, Offset: 321},
+				{Apid: 101, Sequence: 7, Size: 85, Offset: 399},
+			},
+		},
+		{
+			File:    "sample.cadu",
+			Decoder: DecodeCADU(),
+			Want: []packet{
+				{Apid: 100, Sequence: 0, Size: 36, Offset: 2},
+				{Apid: 101, Sequence: 1, Size: 43, Offset: 2},
+				{Apid: 102, Sequence: 2, Size: 50, Offset: 2},
+				{Apid: 100, Sequence: 3, Size: 57, Offset: 116},
+				{Apid: 101, Sequence: 4, Size: 64, Offset: 116},
+				{Apid: 102, Sequence: 5, Size: 71, Offset: 230},
+				{Apid: 100, Sequence: 6, Size: 78, Offset: 344},
+				{Apid: 101, Sequence: 7, Size: 85, Offset: 344},
+			},
+		},
+	}
+	for _, d := range data {
+		var (
+			ix   int
+			file = filepath.Join("testdata", d.File)
+		)
+		handle := func(err error) error {
+			t.Errorf("%s: unexpected error: %s", d.File, err)
+			return nil
+		}
+		for p := range WalkTraced([]string{file}, d.Decoder, handle) {
+			if ix >= len(d.Want) {
+				t.Errorf("%s: too many packets decoded", d.File)
+				break
+			}
+			c, ok := p.Packet.(*CCSDSPacket)
+			if !ok {
+				t.Fatalf("%s: unexpected packet type %T", d.File, p.Packet)
+			}
+			got := packet{
+				Apid:     c.CCSDS.Apid(),
+				Sequence: c.Sequence(),
+				Size:     c.CCSDS.Size(),
+				Offset:   p.Offset,
+			}
+			if want := d.Want[ix]; got != want {
+				t.Errorf("%s: packet %d: want %+v, got %+v", d.File, ix, want, got)
+			}
+			if c.Error() {
+				t.Errorf("%s: packet %d: size mismatch", d.File, ix)
+			}
+			if !c.Reception().IsZero() {
+				t.Errorf("%s: packet %d: unexpected reception time", d.File, ix)
+			}
+			ix++
+		}
+		if ix != len(d.Want) {
+			t.Errorf("%s: want %d packets, got %d", d.File, len(d.Want), ix)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	ExtGzip = ".gz"
+	ExtZstd = ".zst"
+	ExtXz   = ".xz"
+)
+
+var (
+	magicGzip = []byte{0x1f, 0x8b, 0x08}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicXz   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+var compressExts = []string{ExtGzip, ExtZstd, ExtXz}
+
+type Compress string
+
+func (c *Compress) Set(v string) error {
+	switch strings.ToLower(v) {
+	default:
+		return fmt.Errorf("unsupported compression %s", v)
+	case "", "none":
+		*c = ""
+	case "gz", "gzip":
+		*c = ExtGzip
+	case "zst", "zstd":
+		*c = ExtZstd
+	case "xz":
+		*c = ExtXz
+	}
+	return nil
+}
+
+func (c *Compress) String() string {
+	return string(*c)
+}
+
+func CompressExt(file string) string {
+	ext := filepath.Ext(file)
+	for _, e := range compressExts {
+		if ext == e {
+			return e
+		}
+	}
+	return ""
+}
+
+func TrimCompressExt(file string) string {
+	return strings.TrimSuffix(file, CompressExt(file))
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if e := c.Close(); err == nil && e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func OpenFile(file string) (io.ReadCloser, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := NewDecompressor(r)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &readCloser{Reader: rc, closers: []io.Closer{rc, r}}, nil
+}
+
+func NewDecompressor(r io.Reader) (io.ReadCloser, error) {
+	rs := bufio.NewReader(r)
+	magic, _ := rs.Peek(len(magicXz))
+	switch {
+	case bytes.HasPrefix(magic, magicGzip) && isGzip(rs):
+		z, err := gzip.NewReader(rs)
+		if err != nil {
+			return nil, err
+		}
+		return z, nil
+	case bytes.HasPrefix(magic, magicZstd):
+		z, err := zstd.NewReader(rs)
+		if err != nil {
+			return nil, err
+		}
+		return z.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, magicXz):
+		z, err := xz.NewReader(rs)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(z), nil
+	default:
+		return ioutil.NopCloser(rs), nil
+	}
+}
+
+// isGzip reports whether the data buffered in rs can be decompressed with gzip.
+// Plain RT files whose first size prefix starts like the gzip magic are read
+// as is.
+func isGzip(rs *bufio.Reader) bool {
+	bs, _ := rs.Peek(rs.Size())
+	z, err := gzip.NewReader(bytes.NewReader(bs))
+	if err == nil {
+		_, err = z.Read(make([]byte, 1))
+	}
+	return err == nil || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (m memReader) Close() error {
+	return nil
+}
+
+// OpenSeeker gives a seekable view of file. Compressed streams can not be
+// seeked in, so compressed files are fully decompressed in memory. Commands
+// that need to seek (sort, merge, shuffle) should be given plain files when
+// their inputs are too large to fit in memory.
+func OpenSeeker(file string) (ReadSeekCloser, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressed(r) {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			r.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+	defer r.Close()
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	rc, err := NewDecompressor(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	defer rc.Close()
+
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return memReader{bytes.NewReader(bs)}, nil
+}
+
+func isCompressed(r io.Reader) bool {
+	magic := make([]byte, len(magicXz))
+	n, _ := io.ReadFull(r, magic)
+	magic = magic[:n]
+	for _, m := range [][]byte{magicGzip, magicZstd, magicXz} {
+		if bytes.HasPrefix(magic, m) {
+			return true
+		}
+	}
+	return false
+}
+
+type writeCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (w *writeCloser) Close() error {
+	var err error
+	for _, c := range w.closers {
+		if e := c.Close(); err == nil && e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func CreateFile(file string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	w, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	ext := CompressExt(file)
+	if ext == "" {
+		return w, nil
+	}
+	wc, err := NewCompressor(w, ext)
+	if err != nil {
+		w.Close()
+		os.Remove(file)
+		return nil, err
+	}
+	return &writeCloser{Writer: wc, closers: []io.Closer{wc, w}}, nil
+}
+
+func NewCompressor(w io.Writer, ext string) (io.WriteCloser, error) {
+	switch ext {
+	case ExtGzip:
+		return gzip.NewWriter(w), nil
+	case ExtZstd:
+		return zstd.NewWriter(w)
+	case ExtXz:
+		return xz.NewWriter(w)
+	case "":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", ext)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (n nopWriteCloser) Close() error {
+	return nil
+}
+
+func CompressFile(file, ext string) error {
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := writeFileAtomic(file+ext, r, make([]byte, 32<<10)); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/midbel/cli"
+	"github.com/midbel/toml"
+)
+
+// Config holds the settings shared by all commands. It is read from the file
+// given with -config, from $MEEX_CONFIG or from the first meex.toml found in
+// the user configuration directory or /etc/meex:
+//
+//	default = "iss"
+//
+//	[[archive]]
+//	name   = "iss"
+//	root   = "/data/iss"
+//	kind   = "vmu"
+//	time   = "gps"
+//	filter = "channel == vic1"
+//
+//	[[listener]]
+//	name     = "hrdl"
+//	archive  = "iss"
+//	address  = "239.192.0.1:10015"
+//	protocol = "udp"
+//	interval = "5m"
+//	compress = "zst"
+//	iface    = "eth1"
+//	rcvbuf   = 8388608
+//	forward  = ["udp://10.0.0.2:10015?filter=channel == vic1"]
+//
+//	[[command]]
+//	name = "list"
+//	args = ["-s", "-f", "csv"]
+//
+// Settings of the selected archive, listener and command are used as default
+// values of the flags of a command; flags given on the command line always
+// take precedence.
+type Config struct {
+	Default   string      `toml:"default"`
+	Archives  []*Archive  `toml:"archive"`
+	Listeners []*Listener `toml:"listener"`
+	Commands  []*Defaults `toml:"command"`
+}
+
+type Archive struct {
+	Name   string `toml:"name"`
+	Root   string `toml:"root"`
+	Kind   string `toml:"kind"`
+	Time   string `toml:"time"`
+	Filter string `toml:"filter"`
+}
+
+type Listener struct {
+	Name     string   `toml:"name"`
+	Archive  string   `toml:"archive"`
+	Addr     string   `toml:"address"`
+	Protocol string   `toml:"protocol"`
+	Kind     string   `toml:"kind"`
+	Interval string   `toml:"interval"`
+	Compress string   `toml:"compress"`
+	Iface    string   `toml:"iface"`
+	Buffer   int      `toml:"rcvbuf"`
+	Forward  []string `toml:"forward"`
+}
+
+type Defaults struct {
+	Name string   `toml:"name"`
+	Args []string `toml:"args"`
+}
+
+const ConfigEnv = "MEEX_CONFIG"
+
+func LoadConfig(file string) (*Config, error) {
+	var c Config
+	if file == "" {
+		file = os.Getenv(ConfigEnv)
+	}
+	if file == "" {
+		file = lookupConfig()
+		if file == "" {
+			return &c, nil
+		}
+	}
+	if err := toml.DecodeFile(file, &c); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	for _, a := range c.Archives {
+		switch strings.ToLower(a.Time) {
+		case "", "utc", "gps":
+		default:
+			return nil, fmt.Errorf("%s: archive %s: unsupported time system %s", file, a.Name, a.Time)
+		}
+	}
+	return &c, nil
+}
+
+func lookupConfig() string {
+	var dirs []string
+	if d, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(d, "meex"))
+	}
+	dirs = append(dirs, "/etc/meex")
+	for _, d := range dirs {
+		file := filepath.Join(d, "meex.toml")
+		if i, err := os.Stat(file); err == nil && i.Mode().IsRegular() {
+			return file
+		}
+	}
+	return ""
+}
+
+func (c *Config) Archive(n string) (*Archive, error) {
+	if n == "" {
+		n = c.Default
+	}
+	if n == "" {
+		return nil, nil
+	}
+	for _, a := range c.Archives {
+		if a.Name == n {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("archive %s not defined", n)
+}
+
+func (c *Config) Listener(n string) (*Listener, error) {
+	for _, i := range c.Listeners {
+		if i.Name == n {
+			return i, nil
+		}
+	}
+	return nil, fmt.Errorf("listener %s not defined", n)
+}
+
+// configFlags gives, by command, the flag set from each key of the archives
+// and listeners. Commands not listed only get the packet type and the filter.
+var configFlags = map[string]map[string]string{
+	"dispatch": {"kind": "k", "filter": "w", "root": "d"},
+	"extract":  {"kind": "k", "filter": "w", "root": "d"},
+	"serve":    {"kind": "k", "root": "d"},
+	"list":     {"kind": "k", "filter": "w", "time": "g"},
+	"diff":     {"kind": "k", "filter": "w", "time": "g"},
+	"count":    {"kind": "k", "filter": "w", "time": "g"},
+	"params":   {"kind": "k", "filter": "w", "time": "g"},
+	"store": {
+		"kind":     "k",
+		"root":     "d",
+		"protocol": "p",
+		"interval": "i",
+		"compress": "z",
+		"iface":    "iface",
+		"rcvbuf":   "rcvbuf",
+		"forward":  "forward",
+	},
+}
+
+var defaultConfigFlags = map[string]string{"kind": "k", "filter": "w"}
+
+// Args gives the default arguments of a command. Values are only set for the
+// flags mapped to the keys of the configuration in configFlags.
+func (c *Config) Args(cmd *cli.Command, archive, listener string) ([]string, error) {
+	name := commandName(cmd)
+	fs, ok := configFlags[name]
+	if !ok {
+		fs = defaultConfigFlags
+	}
+	var (
+		as  []string
+		set = func(key, value string) {
+			n, ok := fs[key]
+			if !ok || value == "" || cmd.Flag.Lookup(n) == nil {
+				return
+			}
+			as = append(as, fmt.Sprintf("-%s=%s", n, value))
+		}
+	)
+	var i *Listener
+	if listener != "" {
+		l, err := c.Listener(listener)
+		if err != nil {
+			return nil, err
+		}
+		if archive == "" {
+			archive = l.Archive
+		}
+		i = l
+	}
+	a, err := c.Archive(archive)
+	if err != nil {
+		return nil, err
+	}
+	if a != nil {
+		set("root", a.Root)
+		set("kind", a.Kind)
+		set("filter", a.Filter)
+		if strings.EqualFold(a.Time, "gps") {
+			set("time", "true")
+		}
+	}
+	if i != nil {
+		set("kind", i.Kind)
+		set("protocol", i.Protocol)
+		set("interval", i.Interval)
+		set("compress", i.Compress)
+		set("iface", i.Iface)
+		if i.Buffer > 0 {
+			set("rcvbuf", fmt.Sprint(i.Buffer))
+		}
+		for _, f := range i.Forward {
+			set("forward", f)
+		}
+	}
+	for _, d := range c.Commands {
+		if d.Name == name {
+			as = append(as, d.Args...)
+		}
+	}
+	return as, nil
+}
+
+// parseArgs parses the arguments of a command and then applies the defaults
+// found in the configuration file to the flags not given on the command line.
+// Arguments are parsed only once so that flags accumulating their values are
+// not set twice.
+func parseArgs(cmd *cli.Command, args []string) error {
+	file := cmd.Flag.String("config", "", "configuration file")
+	archive := cmd.Flag.String("archive", "", "archive defined in configuration file")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	cmd.Flag.Visit(func(f *flag.Flag) {
+		seen[f.Name] = true
+	})
+	var listener string
+	if f := cmd.Flag.Lookup("listener"); f != nil {
+		listener = f.Value.String()
+	}
+	c, err := LoadConfig(*file)
+	if err != nil {
+		return err
+	}
+	as, err := c.Args(cmd, *archive, listener)
+	if err != nil {
+		return err
+	}
+	if len(as) > 0 {
+		fs := flag.NewFlagSet(commandName(cmd), flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		cmd.Flag.VisitAll(func(f *flag.Flag) {
+			fs.Var(&configValue{Value: f.Value, skip: seen[f.Name]}, f.Name, f.Usage)
+		})
+		if err := fs.Parse(as); err != nil {
+			return fmt.Errorf("%s: %s", commandName(cmd), err)
+		}
+		if fs.NArg() > 0 {
+			return fmt.Errorf("%s: unexpected arguments in configuration: %s", commandName(cmd), strings.Join(fs.Args(), " "))
+		}
+	}
+	if listener != "" && cmd.Flag.NArg() == 0 {
+		if i, _ := c.Listener(listener); i.Addr != "" {
+			return cmd.Flag.Parse([]string{i.Addr})
+		}
+	}
+	return nil
+}
+
+// configValue sets a flag from the configuration unless it was given on the
+// command line.
+type configValue struct {
+	flag.Value
+	skip bool
+}
+
+func (c *configValue) Set(v string) error {
+	if c.skip {
+		return nil
+	}
+	return c.Value.Set(v)
+}
+
+func (c *configValue) IsBoolFlag() bool {
+	b, ok := c.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func commandName(cmd *cli.Command) string {
+	fs := strings.Fields(cmd.Usage)
+	if len(fs) == 0 {
+		return ""
+	}
+	return fs[0]
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrTruncated   = errors.New("truncated file")
+	ErrUnknownKind = errors.New("unknown packet kind")
+	ErrNoDatadir   = errors.New("no data directory provided (use -d or -archive)")
+	ErrTooLarge    = errors.New("packet too large")
+)
+
+const (
+	ExitOk      = 0
+	ExitFailure = 1
+	ExitRead    = 3
+	ExitInvalid = 4
+	ExitPanic   = 5
+)
+
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+type PacketError struct {
+	Provenance
+	Err error
+}
+
+func (e *PacketError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("offset %d: %s", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Provenance, e.Err)
+}
+
+type ErrorHandler func(error) error
+
+func errorClass(err error) string {
+	e, ok := err.(*PacketError)
+	if !ok {
+		return "read"
+	}
+	switch e.Err {
+	case ErrShortBuffer:
+		return "short buffer"
+	case ErrTruncated:
+		return "truncated"
+	case ErrUnknownKind:
+		return "unknown kind"
+	default:
+		return "decode"
+	}
+}
+
+type Errors struct {
+	Strict bool
+
+	mu     sync.Mutex
+	counts map[string]int
+	failed int
+	err    error
+}
+
+func (e *Errors) Handle(err error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.counts == nil {
+		e.counts = make(map[string]int)
+	}
+	e.counts[errorClass(err)]++
+	if _, ok := err.(*PacketError); !ok {
+		e.failed++
+		log.Printf("error: %s", err)
+	}
+	if !e.Strict {
+		return nil
+	}
+	if e.err == nil {
+		e.err = err
+	}
+	return err
+}
+
+func (e *Errors) Summary() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.counts) == 0 {
+		return
+	}
+	var (
+		total int
+		cs    = make([]string, 0, len(e.counts))
+	)
+	for c, n := range e.counts {
+		total += n
+		cs = append(cs, fmt.Sprintf("%d %s", n, c))
+	}
+	sort.Strings(cs)
+	log.Printf("%d errors found (%s)", total, strings.Join(cs, ", "))
+}
+
+func (e *Errors) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case e.err != nil:
+		code := ExitInvalid
+		if _, ok := e.err.(*PacketError); !ok {
+			code = ExitRead
+		}
+		return &ExitError{Code: code, Err: e.err}
+	case e.failed > 0:
+		return &ExitError{Code: ExitRead, Err: fmt.Errorf("%d source(s) can not be read", e.failed)}
+	default:
+		return nil
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"container/list"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
 	"time"
 
 	"github.com/midbel/cli"
@@ -14,88 +16,325 @@ import (
 )
 
 var dispatchCommand = &cli.Command{
-	Usage: "dispatch [-k type] [-d datadir] <file...>",
+	Usage: "dispatch [-k type] [-m stream] [-w filter] [-n files] [-z compression] [-d datadir] [-b playback-datadir] [-strict] <file...>",
 	Short: "dispatch packets in the correct location",
 	Run:   runDispatch,
 }
 
 var extractCommand = &cli.Command{
-	Usage: "extract [-p pid] [-k type] [-t time] [-i interval] [-d datadir] [-c body-only] <file...>",
+	Usage: "extract [-p pid] [-k type] [-m stream] [-w filter] [-t time] [-i interval] [-z compression] [-d datadir] [-c body-only] [-strict] <file...>",
 	Alias: []string{"filter"},
 	Short: "extract packets from RT file(s)",
 	Run:   runExtract,
 }
 
 func runDispatch(cmd *cli.Command, args []string) error {
-	var kind Kind
+	var (
+		kind   Kind
+		stream Stream
+		filter Filter
+		z      Compress
+		errs   Errors
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
-	datadir := cmd.Flag.String("d", os.TempDir(), "data directory")
-	if err := cmd.Flag.Parse(args); err != nil {
+	cmd.Flag.Var(&stream, "m", "realtime or playback stream")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.Var(&z, "z", "compression (gz, zst, xz)")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	datadir := cmd.Flag.String("d", "", "data directory")
+	pbdir := cmd.Flag.String("b", "", "playback data directory")
+	limit := cmd.Flag.Int("n", DefaultOpenFiles, "maximum number of open files")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(*datadir, 0755); err != nil && !os.IsExist(err) {
+	if *datadir == "" {
+		return ErrNoDatadir
+	}
+	ds, err := NewDispatcher(*datadir, *pbdir, kind, *limit, z)
+	if err != nil {
 		return err
 	}
+	for p := range WalkTraced(cmd.Flag.Args(), DecodeByFilter(&filter, DecodeByStream(stream, kind.Decod)), errs.Handle) {
+		if err := ds.Dispatch(p.Packet); err != nil {
+			ds.Close()
+			return err
+		}
+	}
+	if err := ds.Close(); err != nil {
+		return err
+	}
+	errs.Summary()
+	return errs.Err()
+}
 
-	ws := make(map[time.Time]io.WriteCloser)
-	delta := GPS.Sub(UNIX)
-	for p := range Walk(cmd.Flag.Args(), kind.Decod) {
-		t := p.Timestamp().Add(delta).Truncate(Five)
-		w, ok := ws[t]
-		if !ok {
-			file, err := TimePath(*datadir, t)
-			if err != nil {
-				return err
+type dispatchKey struct {
+	When time.Time
+	Dir  string
+}
+
+type dispatchFile struct {
+	file string
+	temp string
+
+	writer *os.File
+	elem   *list.Element
+}
+
+type dispatcher struct {
+	datadir string
+	pbdir   string
+
+	decoder Decoder
+	sort    SortFunc
+
+	limit  int
+	ext    string
+	files  map[dispatchKey]*dispatchFile
+	opened *list.List
+}
+
+const DefaultOpenFiles = 64
+
+func NewDispatcher(datadir, pbdir string, kind Kind, limit int, z Compress) (*dispatcher, error) {
+	if kind.Decod == nil {
+		return nil, fmt.Errorf("no packet type provided")
+	}
+	for _, d := range []string{datadir, pbdir} {
+		if d == "" {
+			continue
+		}
+		if err := os.MkdirAll(d, 0755); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	if limit <= 0 {
+		limit = DefaultOpenFiles
+	}
+	d := dispatcher{
+		datadir: datadir,
+		pbdir:   pbdir,
+		decoder: kind.Decod,
+		sort:    kind.Sort,
+		limit:   limit,
+		ext:     string(z),
+		files:   make(map[dispatchKey]*dispatchFile),
+		opened:  list.New(),
+	}
+	return &d, nil
+}
+
+func (d *dispatcher) Dispatch(p Packet) error {
+	k := dispatchKey{
+		When: p.Timestamp().Add(GPS.Sub(UNIX)).Truncate(Five),
+		Dir:  d.datadir,
+	}
+	if rt, ok := streamOf(p); ok && d.pbdir != "" && !rt {
+		k.Dir = d.pbdir
+	}
+	f, err := d.open(k)
+	if err != nil {
+		return err
+	}
+	_, err = f.writer.Write(p.Bytes())
+	return err
+}
+
+func (d *dispatcher) open(k dispatchKey) (*dispatchFile, error) {
+	f, ok := d.files[k]
+	if !ok {
+		file, err := TimePath(k.Dir, k.When)
+		if err != nil {
+			return nil, err
+		}
+		file += d.ext
+		dir, base := filepath.Split(file)
+		w, err := ioutil.TempFile(dir, "."+base+".")
+		if err != nil {
+			return nil, err
+		}
+		f = &dispatchFile{
+			file:   file,
+			temp:   w.Name(),
+			writer: w,
+		}
+		d.files[k] = f
+	}
+	if f.writer == nil {
+		w, err := os.OpenFile(f.temp, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.writer = w
+	}
+	if f.elem == nil {
+		f.elem = d.opened.PushFront(f)
+	} else {
+		d.opened.MoveToFront(f.elem)
+	}
+	for d.opened.Len() > d.limit {
+		e := d.opened.Back()
+		o := d.opened.Remove(e).(*dispatchFile)
+		o.elem = nil
+		if err := o.writer.Close(); err != nil {
+			return nil, err
+		}
+		o.writer = nil
+	}
+	return f, nil
+}
+
+func (d *dispatcher) Close() error {
+	ks := make([]dispatchKey, 0, len(d.files))
+	for k := range d.files {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if ks[i].When.Equal(ks[j].When) {
+			return ks[i].Dir < ks[j].Dir
+		}
+		return ks[i].When.Before(ks[j].When)
+	})
+
+	var (
+		err    error
+		buffer = make([]byte, MaxBufferSize)
+	)
+	for _, k := range ks {
+		f := d.files[k]
+		if f.writer != nil {
+			if e := f.writer.Close(); err == nil && e != nil {
+				err = e
 			}
-			w, err = os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return err
+			f.writer = nil
+		}
+		if e := d.merge(f, buffer); e != nil {
+			// the archive file is left untouched: new packets are kept aside
+			// instead of being lost
+			if err == nil {
+				err = fmt.Errorf("%s: %s (packets kept in %s)", f.file, e, f.temp)
 			}
-			defer w.Close()
-			ws[t] = w
+		} else {
+			os.Remove(f.temp)
 		}
-		if _, err := w.Write(p.Bytes()); err != nil {
+		delete(d.files, k)
+	}
+	d.opened.Init()
+	return err
+}
+
+func (d *dispatcher) merge(f *dispatchFile, buffer []byte) error {
+	var (
+		rs    = make([]io.ReadSeeker, 0, 2)
+		files []string
+	)
+	base := TrimCompressExt(f.file)
+	for _, e := range append([]string{""}, compressExts...) {
+		r, err := OpenSeeker(base + e)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
 			return err
 		}
+		defer r.Close()
+		rs = append(rs, r)
+		files = append(files, base+e)
+	}
+	r, err := os.Open(f.temp)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rs = append(rs, r)
+
+	mr, err := MergeWith(d.decoder, d.sort, rs...)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(f.file, mr, buffer); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file != f.file {
+			os.Remove(file)
+		}
 	}
 	return nil
 }
 
+func writeFileAtomic(file string, r io.Reader, buffer []byte) error {
+	dir, base := filepath.Split(file)
+	w, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	z, err := NewCompressor(w, CompressExt(file))
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return err
+	}
+	// hide os.File.ReadFrom so that io.CopyBuffer really uses buffer
+	ws := struct{ io.Writer }{z}
+	if _, err := io.CopyBuffer(ws, r, buffer); err != nil {
+		z.Close()
+		w.Close()
+		os.Remove(w.Name())
+		return err
+	}
+	if err := z.Close(); err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return err
+	}
+	if err := w.Chmod(0644); err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), file)
+}
+
 func runExtract(cmd *cli.Command, args []string) error {
+	var (
+		stream Stream
+		filter Filter
+		z      Compress
+		errs   Errors
+		kind   Kind
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&stream, "m", "realtime or playback stream")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.Var(&z, "z", "compression (gz, zst, xz)")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
 	id := cmd.Flag.Int("p", 0, "packet id")
 	reception := cmd.Flag.String("t", "", "reception time")
-	datadir := cmd.Flag.String("d", os.TempDir(), "data directory")
+	datadir := cmd.Flag.String("d", "", "data directory")
 	interval := cmd.Flag.Duration("i", 0, "interval")
-	kind := cmd.Flag.String("k", "", "packet type")
 	cut := cmd.Flag.Bool("c", false, "only packets body")
-	if err := cmd.Flag.Parse(args); err != nil {
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
-
-	var (
-		d    Decoder
-		size int
-	)
-	switch strings.ToLower(*kind) {
-	default:
-		return fmt.Errorf("unsupported packet type %s", *kind)
-	case "pd", "pp":
-		if *cut {
-			size = UMIHeaderLen
-		}
-		d = DecodePD()
-	case "tm", "pth":
-		if *cut {
-			size = PTHHeaderLen
-		}
-		d = DecodeTM()
-	case "hrdl", "hrd", "vmu":
-		if *cut {
-			size = HRDLHeaderLen
-		}
-		d = DecodeVMU()
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	if *datadir == "" {
+		return ErrNoDatadir
+	}
+	var size int
+	if *cut {
+		size = kind.Header
 	}
-	d = DecodeById(*id, d)
+	if kind.Name == "hrd" {
+		// hrd packets are extracted with the VMU records carrying them.
+		kind.Decod = DecodeVMU()
+	}
+	d := DecodeByFilter(&filter, DecodeByStream(stream, DecodeById(*id, kind.Decod)))
 
 	var when time.Time
 	if w, err := time.Parse(time.RFC3339, *reception); *reception != "" && err == nil {
@@ -110,10 +349,10 @@ func runExtract(cmd *cli.Command, args []string) error {
 	sema := make(chan struct{}, 4)
 	defer close(sema)
 	for _, a := range cmd.Flag.Args() {
-		src, dst := a, filepath.Join(*datadir, a)
+		src, dst := a, filepath.Join(*datadir, TrimCompressExt(a)+string(z))
 		group.Go(func() error {
 			sema <- struct{}{}
-			c, err := extractPackets(src, dst, d, size, when, *interval)
+			c, err := extractPackets(src, dst, d, size, when, *interval, errs.Handle)
 			if err != nil {
 				os.Remove(dst)
 			} else {
@@ -123,20 +362,24 @@ func runExtract(cmd *cli.Command, args []string) error {
 			return err
 		})
 	}
-	return group.Wait()
+	if err := group.Wait(); err != nil {
+		if e := errs.Err(); e != nil {
+			return e
+		}
+		return err
+	}
+	errs.Summary()
+	return errs.Err()
 }
 
-func extractPackets(src, dst string, d Decoder, cut int, when time.Time, interval time.Duration) (*Coze, error) {
-	r, err := os.Open(src)
+func extractPackets(src, dst string, d Decoder, cut int, when time.Time, interval time.Duration, fn ErrorHandler) (*Coze, error) {
+	r, err := OpenFile(src)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
 
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil && !os.IsExist(err) {
-		return nil, err
-	}
-	w, err := os.Create(dst)
+	w, err := CreateFile(dst)
 	if err != nil {
 		return nil, err
 	}
@@ -144,6 +387,17 @@ func extractPackets(src, dst string, d Decoder, cut int, when time.Time, interva
 
 	rt, ws := NewReader(r, d), NoDuplicate(w)
 
+	var failed error
+	rt.OnError(func(err error) error {
+		if e, ok := err.(*PacketError); ok {
+			e.File = src
+		} else {
+			err = fmt.Errorf("%s: %s", src, err)
+		}
+		failed = fn(err)
+		return failed
+	})
+
 	var c Coze
 	for p := range rt.Packets() {
 		c.Count++
@@ -158,14 +412,17 @@ func extractPackets(src, dst string, d Decoder, cut int, when time.Time, interva
 			c.Size += uint64(n)
 		}
 	}
-	return &c, nil
+	if failed != nil {
+		return nil, failed
+	}
+	return &c, w.Close()
 }
 
 func shouldKeepPacket(p Packet, ref time.Time, interval time.Duration) bool {
 	if ref.IsZero() && interval == 0 {
 		return true
 	}
-	if p.Reception().After(time.Now()) {
+	if r := p.Reception(); r.IsZero() || r.After(time.Now()) {
 		return false
 	}
 	if !ref.IsZero() && p.Reception().Before(ref) {
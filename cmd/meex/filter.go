@@ -0,0 +1,900 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Filter struct {
+	expr  string
+	match matcher
+}
+
+func ParseFilter(str string) (*Filter, error) {
+	var f Filter
+	if err := f.Set(str); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (f *Filter) Set(v string) error {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		f.expr, f.match = "", nil
+		return nil
+	}
+	m, err := compileFilter(v)
+	if err != nil {
+		return err
+	}
+	f.expr, f.match = v, m
+	return nil
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+func (f *Filter) Match(p Packet) bool {
+	if f == nil || f.match == nil {
+		return true
+	}
+	return f.match.Match(p)
+}
+
+type matcher interface {
+	Match(Packet) bool
+}
+
+type matchFunc func(Packet) bool
+
+func (m matchFunc) Match(p Packet) bool {
+	return m(p)
+}
+
+type fieldType uint8
+
+const (
+	fieldInt fieldType = iota
+	fieldString
+	fieldBool
+	fieldTime
+	fieldDuration
+)
+
+func (f fieldType) String() string {
+	switch f {
+	case fieldInt:
+		return "integer"
+	case fieldString:
+		return "string"
+	case fieldBool:
+		return "boolean"
+	case fieldTime:
+		return "time"
+	case fieldDuration:
+		return "duration"
+	default:
+		return "***"
+	}
+}
+
+type field struct {
+	kind fieldType
+	get  func(Packet) (interface{}, bool)
+	// norm, when set, normalizes the values given in expressions before
+	// they are compared.
+	norm func(string) string
+}
+
+var fields = map[string]field{
+	"kind": {
+		kind: fieldString,
+		get: func(p Packet) (interface{}, bool) {
+			switch p := p.(type) {
+			case *TMPacket:
+				return "tm", true
+			case *CCSDSPacket:
+				return p.Kind(), true
+			case *PDPacket:
+				return "pd", true
+			case *VMUPacket:
+				return "vmu", true
+			case HRPacket:
+				return "hrd", true
+			default:
+				return nil, false
+			}
+		},
+		norm: kindName,
+	},
+	"id": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			id, _ := p.Id()
+			return int64(id), true
+		},
+	},
+	"sequence": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			return int64(p.Sequence()), true
+		},
+	},
+	"size": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			return int64(p.Len()), true
+		},
+	},
+	"timestamp": {
+		kind: fieldTime,
+		get: func(p Packet) (interface{}, bool) {
+			return p.Timestamp(), true
+		},
+	},
+	"reception": {
+		kind: fieldTime,
+		get: func(p Packet) (interface{}, bool) {
+			t := p.Reception()
+			if t.IsZero() {
+				return nil, false
+			}
+			return t, true
+		},
+	},
+	"latency": {
+		kind: fieldDuration,
+		get: func(p Packet) (interface{}, bool) {
+			t := p.Reception()
+			if t.IsZero() {
+				return nil, false
+			}
+			return t.Sub(p.Timestamp()), true
+		},
+	},
+	"error": {
+		kind: fieldBool,
+		get: func(p Packet) (interface{}, bool) {
+			return p.Error(), true
+		},
+	},
+	"valid": {
+		kind: fieldBool,
+		get: func(p Packet) (interface{}, bool) {
+			return !p.Error(), true
+		},
+	},
+	"realtime": {
+		kind: fieldBool,
+		get: func(p Packet) (interface{}, bool) {
+			if rt, ok := streamOf(p); ok {
+				return rt, true
+			}
+			return nil, false
+		},
+	},
+	"playback": {
+		kind: fieldBool,
+		get: func(p Packet) (interface{}, bool) {
+			if rt, ok := streamOf(p); ok {
+				return !rt, true
+			}
+			return nil, false
+		},
+	},
+	"apid": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			switch p := p.(type) {
+			case *TMPacket:
+				return int64(p.CCSDS.Apid()), true
+			case *CCSDSPacket:
+				return int64(p.CCSDS.Apid()), true
+			default:
+				return nil, false
+			}
+		},
+	},
+	"grouping": {
+		kind: fieldString,
+		get: func(p Packet) (interface{}, bool) {
+			switch p := p.(type) {
+			case *TMPacket:
+				return p.CCSDS.Grouping().String(), true
+			case *CCSDSPacket:
+				return p.CCSDS.Grouping().String(), true
+			default:
+				return nil, false
+			}
+		},
+	},
+	"source": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			if p, ok := p.(*TMPacket); ok {
+				return int64(p.ESA.Source), true
+			}
+			return nil, false
+		},
+	},
+	"type": {
+		kind: fieldString,
+		get: func(p Packet) (interface{}, bool) {
+			switch p := p.(type) {
+			case *TMPacket:
+				return p.ESA.PacketType().String(), true
+			case *PDPacket:
+				return p.UMI.Type.String(), true
+			case *VMUPacket:
+				hr, err := p.Data()
+				if err != nil || hr == nil {
+					return nil, false
+				}
+				return hr.Type(), true
+			case HRPacket:
+				return p.Type(), true
+			default:
+				return nil, false
+			}
+		},
+	},
+	"channel": {
+		kind: fieldString,
+		get: func(p Packet) (interface{}, bool) {
+			if p, ok := p.(*VMUPacket); ok {
+				return p.VMU.Channel.String(), true
+			}
+			return nil, false
+		},
+	},
+	"origin": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			switch p := p.(type) {
+			case *VMUPacket:
+				return int64(p.VMU.Origin), true
+			case *Image:
+				return int64(p.Origin), true
+			case *Table:
+				return int64(p.Origin), true
+			default:
+				return nil, false
+			}
+		},
+	},
+	"upi": {
+		kind: fieldString,
+		get: func(p Packet) (interface{}, bool) {
+			switch p := p.(type) {
+			case *VMUPacket:
+				hr, err := p.Data()
+				if err != nil || hr == nil {
+					return nil, false
+				}
+				return hr.String(), true
+			case HRPacket:
+				return p.String(), true
+			default:
+				return nil, false
+			}
+		},
+	},
+	"code": {
+		kind: fieldString,
+		get: func(p Packet) (interface{}, bool) {
+			if p, ok := p.(*PDPacket); ok {
+				return fmt.Sprintf("%x", p.UMI.Code[:]), true
+			}
+			return nil, false
+		},
+	},
+	"orbit": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			if p, ok := p.(*PDPacket); ok {
+				return int64(p.UMI.Orbit), true
+			}
+			return nil, false
+		},
+	},
+	"state": {
+		kind: fieldString,
+		get: func(p Packet) (interface{}, bool) {
+			if p, ok := p.(*PDPacket); ok {
+				return p.UMI.State.String(), true
+			}
+			return nil, false
+		},
+	},
+	"errcode": {
+		kind: fieldInt,
+		get: func(p Packet) (interface{}, bool) {
+			if p, ok := p.(*VMUPacket); ok {
+				return int64(p.HRH.Error), true
+			}
+			return nil, false
+		},
+	},
+}
+
+var aliases = map[string]string{
+	"seq":         "sequence",
+	"len":         "size",
+	"length":      "size",
+	"time":        "timestamp",
+	"acquisition": "timestamp",
+	"umi":         "code",
+	"pid":         "id",
+	"segment":     "grouping",
+}
+
+func lookupField(n string) (field, error) {
+	n = strings.ToLower(n)
+	if a, ok := aliases[n]; ok {
+		n = a
+	}
+	f, ok := fields[n]
+	if !ok {
+		return f, fmt.Errorf("filter: unknown field %q", n)
+	}
+	return f, nil
+}
+
+const (
+	tokEOF rune = -(iota + 1)
+	tokIdent
+	tokNumber
+	tokDuration
+	tokString
+	tokEqual
+	tokNotEqual
+	tokLesser
+	tokLesserEq
+	tokGreater
+	tokGreaterEq
+	tokMatch
+	tokNotMatch
+	tokAnd
+	tokOr
+	tokNot
+	tokIn
+	tokInvalid
+)
+
+type token struct {
+	kind    rune
+	literal string
+	pos     int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.literal)
+	default:
+		return t.literal
+	}
+}
+
+type lexer struct {
+	input []rune
+	pos   int
+}
+
+func (x *lexer) Next() token {
+	for x.pos < len(x.input) && unicode.IsSpace(x.input[x.pos]) {
+		x.pos++
+	}
+	if x.pos >= len(x.input) {
+		return token{kind: tokEOF, pos: x.pos}
+	}
+	start, r := x.pos, x.input[x.pos]
+	switch {
+	case r == '"' || r == '\'':
+		return x.scanString(r)
+	case unicode.IsDigit(r) || (r == '-' && x.peek(1) != 0 && unicode.IsDigit(x.peek(1))):
+		return x.scanNumber()
+	case unicode.IsLetter(r) || r == '_':
+		for x.pos < len(x.input) && isIdent(x.input[x.pos]) {
+			x.pos++
+		}
+		str := string(x.input[start:x.pos])
+		t := token{kind: tokIdent, literal: str, pos: start}
+		switch strings.ToLower(str) {
+		case "and":
+			t.kind = tokAnd
+		case "or":
+			t.kind = tokOr
+		case "not":
+			t.kind = tokNot
+		case "in":
+			t.kind = tokIn
+		}
+		return t
+	}
+	x.pos++
+	t := token{kind: r, literal: string(r), pos: start}
+	switch n := x.peek(0); r {
+	case '(', ')', ',':
+	case '=':
+		switch n {
+		case '=':
+			t.kind, t.literal = tokEqual, "=="
+			x.pos++
+		case '~':
+			t.kind, t.literal = tokMatch, "=~"
+			x.pos++
+		default:
+			t.kind = tokEqual
+		}
+	case '!':
+		switch n {
+		case '=':
+			t.kind, t.literal = tokNotEqual, "!="
+			x.pos++
+		case '~':
+			t.kind, t.literal = tokNotMatch, "!~"
+			x.pos++
+		default:
+			t.kind = tokNot
+		}
+	case '<':
+		t.kind = tokLesser
+		if n == '=' {
+			t.kind, t.literal = tokLesserEq, "<="
+			x.pos++
+		}
+	case '>':
+		t.kind = tokGreater
+		if n == '=' {
+			t.kind, t.literal = tokGreaterEq, ">="
+			x.pos++
+		}
+	case '&':
+		if n == '&' {
+			t.kind, t.literal = tokAnd, "&&"
+			x.pos++
+		} else {
+			t.kind = tokInvalid
+		}
+	case '|':
+		if n == '|' {
+			t.kind, t.literal = tokOr, "||"
+			x.pos++
+		} else {
+			t.kind = tokInvalid
+		}
+	default:
+		t.kind = tokInvalid
+	}
+	return t
+}
+
+func (x *lexer) peek(n int) rune {
+	if x.pos+n >= len(x.input) {
+		return 0
+	}
+	return x.input[x.pos+n]
+}
+
+func (x *lexer) scanString(quote rune) token {
+	start := x.pos
+	x.pos++
+	var str []rune
+	for x.pos < len(x.input) && x.input[x.pos] != quote {
+		if x.input[x.pos] == '\\' && x.pos+1 < len(x.input) {
+			x.pos++
+		}
+		str = append(str, x.input[x.pos])
+		x.pos++
+	}
+	if x.pos >= len(x.input) {
+		return token{kind: tokInvalid, literal: string(x.input[start:]), pos: start}
+	}
+	x.pos++
+	return token{kind: tokString, literal: string(str), pos: start}
+}
+
+func (x *lexer) scanNumber() token {
+	start := x.pos
+	x.pos++
+	for x.pos < len(x.input) && (isIdent(x.input[x.pos]) || x.input[x.pos] == '.') {
+		x.pos++
+	}
+	str := string(x.input[start:x.pos])
+	if _, err := strconv.ParseInt(str, 0, 64); err == nil {
+		return token{kind: tokNumber, literal: str, pos: start}
+	}
+	if _, err := time.ParseDuration(str); err == nil {
+		return token{kind: tokDuration, literal: str, pos: start}
+	}
+	return token{kind: tokInvalid, literal: str, pos: start}
+}
+
+func isIdent(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+type parser struct {
+	lex  *lexer
+	curr token
+	peek token
+}
+
+func compileFilter(str string) (matcher, error) {
+	p := parser{lex: &lexer{input: []rune(str)}}
+	p.next()
+	p.next()
+
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.curr.kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return m, nil
+}
+
+func (p *parser) next() {
+	p.curr = p.peek
+	p.peek = p.lex.Next()
+}
+
+func (p *parser) unexpected() error {
+	return fmt.Errorf("filter: unexpected %s at position %d", p.curr, p.curr.pos+1)
+}
+
+func (p *parser) parseOr() (matcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.curr.kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orMatcher(left, right)
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (matcher, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.curr.kind == tokAnd {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andMatcher(left, right)
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (matcher, error) {
+	if p.curr.kind != tokNot {
+		return p.parsePrimary()
+	}
+	p.next()
+	m, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return notMatcher(m), nil
+}
+
+func (p *parser) parsePrimary() (matcher, error) {
+	switch p.curr.kind {
+	case '(':
+		p.next()
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.curr.kind != ')' {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return m, nil
+	case tokIdent:
+		return p.parseComparison()
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+func (p *parser) parseComparison() (matcher, error) {
+	name := p.curr.literal
+	f, err := lookupField(name)
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+
+	switch op := p.curr.kind; op {
+	case tokEqual, tokNotEqual, tokLesser, tokLesserEq, tokGreater, tokGreaterEq:
+		p.next()
+		v, err := p.parseValue(name, f)
+		if err != nil {
+			return nil, err
+		}
+		if f.kind == fieldBool && op != tokEqual && op != tokNotEqual {
+			return nil, fmt.Errorf("filter: %s: operator %q not supported by boolean field", name, opLiteral(op))
+		}
+		return compareMatcher(f, op, v), nil
+	case tokMatch, tokNotMatch:
+		if f.kind != fieldString {
+			return nil, fmt.Errorf("filter: %s: operator %q only supported by string field", name, opLiteral(op))
+		}
+		p.next()
+		if p.curr.kind != tokString {
+			return nil, p.unexpected()
+		}
+		re, err := regexp.Compile(p.curr.literal)
+		if err != nil {
+			return nil, fmt.Errorf("filter: %s: %s", name, err)
+		}
+		p.next()
+		m := regexMatcher(f, re)
+		if op == tokNotMatch {
+			m = notMatcher(m)
+		}
+		return m, nil
+	case tokIn:
+		p.next()
+		return p.parseList(name, f)
+	case tokNot:
+		if p.peek.kind != tokIn {
+			break
+		}
+		p.next()
+		p.next()
+		m, err := p.parseList(name, f)
+		if err != nil {
+			return nil, err
+		}
+		return notMatcher(m), nil
+	}
+	if f.kind != fieldBool {
+		return nil, fmt.Errorf("filter: %s: %s field can not be used as condition", name, f.kind)
+	}
+	return compareMatcher(f, tokEqual, true), nil
+}
+
+func (p *parser) parseList(name string, f field) (matcher, error) {
+	if p.curr.kind != '(' {
+		return nil, p.unexpected()
+	}
+	p.next()
+
+	var vs []interface{}
+	for p.curr.kind != ')' {
+		v, err := p.parseValue(name, f)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+		switch p.curr.kind {
+		case ',':
+			p.next()
+		case ')':
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	p.next()
+	if len(vs) == 0 {
+		return nil, fmt.Errorf("filter: %s: empty list", name)
+	}
+	return listMatcher(f, vs), nil
+}
+
+func (p *parser) parseValue(name string, f field) (interface{}, error) {
+	var (
+		tok  = p.curr
+		kind = f.kind
+		val  interface{}
+		err  error
+	)
+	switch kind {
+	case fieldInt:
+		if tok.kind != tokNumber {
+			break
+		}
+		val, err = strconv.ParseInt(tok.literal, 0, 64)
+	case fieldDuration:
+		if tok.kind != tokDuration && tok.kind != tokString {
+			break
+		}
+		val, err = time.ParseDuration(tok.literal)
+	case fieldBool:
+		if tok.kind != tokIdent {
+			break
+		}
+		val, err = strconv.ParseBool(tok.literal)
+	case fieldString:
+		if tok.kind == tokString || tok.kind == tokIdent || tok.kind == tokNumber {
+			val = tok.literal
+			if f.norm != nil {
+				val = f.norm(tok.literal)
+			}
+		}
+	case fieldTime:
+		if tok.kind != tokString {
+			break
+		}
+		val, err = parseFilterTime(tok.literal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter: %s: invalid value %s (%s)", name, tok, err)
+	}
+	if val == nil {
+		return nil, fmt.Errorf("filter: %s: expected %s value, got %s", name, kind, tok)
+	}
+	p.next()
+	return val, nil
+}
+
+func parseFilterTime(str string) (time.Time, error) {
+	for _, f := range []string{time.RFC3339, TimeFormat, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(f, str); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time format")
+}
+
+func opLiteral(op rune) string {
+	switch op {
+	case tokEqual:
+		return "=="
+	case tokNotEqual:
+		return "!="
+	case tokLesser:
+		return "<"
+	case tokLesserEq:
+		return "<="
+	case tokGreater:
+		return ">"
+	case tokGreaterEq:
+		return ">="
+	case tokMatch:
+		return "=~"
+	case tokNotMatch:
+		return "!~"
+	default:
+		return string(op)
+	}
+}
+
+func andMatcher(left, right matcher) matcher {
+	return matchFunc(func(p Packet) bool {
+		return left.Match(p) && right.Match(p)
+	})
+}
+
+func orMatcher(left, right matcher) matcher {
+	return matchFunc(func(p Packet) bool {
+		return left.Match(p) || right.Match(p)
+	})
+}
+
+func notMatcher(m matcher) matcher {
+	return matchFunc(func(p Packet) bool {
+		return !m.Match(p)
+	})
+}
+
+func compareMatcher(f field, op rune, v interface{}) matcher {
+	return matchFunc(func(p Packet) bool {
+		fv, ok := f.get(p)
+		if !ok {
+			return false
+		}
+		c := compareValues(fv, v)
+		switch op {
+		case tokEqual:
+			return c == 0
+		case tokNotEqual:
+			return c != 0
+		case tokLesser:
+			return c < 0
+		case tokLesserEq:
+			return c <= 0
+		case tokGreater:
+			return c > 0
+		case tokGreaterEq:
+			return c >= 0
+		default:
+			return false
+		}
+	})
+}
+
+func listMatcher(f field, vs []interface{}) matcher {
+	return matchFunc(func(p Packet) bool {
+		fv, ok := f.get(p)
+		if !ok {
+			return false
+		}
+		for _, v := range vs {
+			if compareValues(fv, v) == 0 {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func regexMatcher(f field, re *regexp.Regexp) matcher {
+	return matchFunc(func(p Packet) bool {
+		fv, ok := f.get(p)
+		if !ok {
+			return false
+		}
+		str, ok := fv.(string)
+		return ok && re.MatchString(str)
+	})
+}
+
+func compareValues(left, right interface{}) int {
+	switch left := left.(type) {
+	case int64:
+		right := right.(int64)
+		if left < right {
+			return -1
+		} else if left > right {
+			return 1
+		}
+		return 0
+	case string:
+		right := right.(string)
+		if strings.EqualFold(left, right) {
+			return 0
+		}
+		return strings.Compare(strings.ToLower(left), strings.ToLower(right))
+	case bool:
+		if left == right.(bool) {
+			return 0
+		}
+		if !left {
+			return -1
+		}
+		return 1
+	case time.Time:
+		right := right.(time.Time)
+		if left.Before(right) {
+			return -1
+		} else if left.After(right) {
+			return 1
+		}
+		return 0
+	case time.Duration:
+		right := right.(time.Duration)
+		if left < right {
+			return -1
+		} else if left > right {
+			return 1
+		}
+		return 0
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileFilter(t *testing.T) {
+	acq := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &TMPacket{
+		PTH:   &PTHHeader{Reception: acq.Add(3 * time.Second)},
+		CCSDS: &CCSDSHeader{Version: 1001, Fragment: 0xC000 | 42},
+		ESA:   &ESAHeader{Acquisition: acq, Info: uint8(ScienceData)},
+	}
+	data := []struct {
+		Expr string
+		Want bool
+		Fail bool
+	}{
+		{Expr: `apid == 1001`, Want: true},
+		{Expr: `apid == 0x3e9`, Want: true},
+		{Expr: `apid != 1001`, Want: false},
+		{Expr: `apid in (1001, 1002)`, Want: true},
+		{Expr: `apid not in (1001, 1002)`, Want: false},
+		{Expr: `sequence >= 42 and sequence < 43`, Want: true},
+		{Expr: `type == "science data"`, Want: true},
+		{Expr: `type =~ "^sci"`, Want: true},
+		{Expr: `type !~ "sci"`, Want: false},
+		{Expr: `latency > 2s && latency <= 3s`, Want: true},
+		{Expr: `latency < 2s || apid > 1000`, Want: true},
+		{Expr: `!(apid < 1000)`, Want: true},
+		{Expr: `not error`, Want: true},
+		{Expr: `valid == true`, Want: true},
+		{Expr: `timestamp >= "2019-01-01" and timestamp < "2019-01-02T00:00:00Z"`, Want: true},
+		{Expr: `kind == tm`, Want: true},
+		{Expr: `kind in (pp, cadu)`, Want: false},
+		{Expr: `channel == vic1`, Want: false},
+		{Expr: `not channel == vic1`, Want: true},
+		{Expr: `errcode == 0`, Want: false},
+		{Expr: `apid`, Fail: true},
+		{Expr: `apid ==`, Fail: true},
+		{Expr: `apid == "1001"`, Fail: true},
+		{Expr: `apid in ()`, Fail: true},
+		{Expr: `(apid == 1001`, Fail: true},
+		{Expr: `apid == 1001 sequence`, Fail: true},
+		{Expr: `latency > 2`, Fail: true},
+		{Expr: `error < true`, Fail: true},
+		{Expr: `type == "science`, Fail: true},
+		{Expr: `unknown == 1`, Fail: true},
+	}
+	for _, d := range data {
+		m, err := compileFilter(d.Expr)
+		if d.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error", d.Expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Expr, err)
+			continue
+		}
+		if got := m.Match(p); got != d.Want {
+			t.Errorf("%s: want %t, got %t", d.Expr, d.Want, got)
+		}
+	}
+}
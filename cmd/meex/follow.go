@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultPoll = time.Second
+
+// Follow holds the settings of the -follow mode of list, diff and verify: the
+// files written by store in a directory are read as they grow and new files are
+// picked up when the buffer rotates.
+type Follow struct {
+	Enabled bool
+	Poll    time.Duration
+	Latency time.Duration
+	Alerts  Alerter
+}
+
+// Walk gives the packets of paths or, in follow mode, of the files being
+// written in the directory given as first path. Packets received later than
+// the latency threshold are reported as alerts.
+func (f *Follow) Walk(ctx context.Context, paths []string, d Decoder, fn ErrorHandler) <-chan *TracedPacket {
+	if !f.Enabled {
+		return WalkContext(ctx, paths, d, fn)
+	}
+	var dir string
+	if len(paths) > 0 {
+		dir = paths[0]
+	}
+	queue := FollowDir(ctx, dir, f.Poll, d, fn)
+	if f.Latency <= 0 {
+		return queue
+	}
+	q := make(chan *TracedPacket)
+	go func() {
+		defer close(q)
+		late := make(map[string]bool)
+		for p := range queue {
+			var (
+				key = defaultPacketKey(p.Packet)
+				lat = time.Since(p.Timestamp().Add(GPS.Sub(UNIX)))
+			)
+			if lat >= f.Latency && !late[key] {
+				f.Alerts.Send(Alert{
+					Type:    AlertLatency,
+					When:    p.Timestamp(),
+					Key:     key,
+					Message: fmt.Sprintf("packet received %s after acquisition", lat.Truncate(time.Millisecond)),
+					Source:  p.Provenance.String(),
+				})
+			}
+			late[key] = lat >= f.Latency
+			select {
+			case q <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// Context gives a context cancelled on interrupt so that commands in follow
+// mode can still report their summary.
+func (f *Follow) Context() (context.Context, context.CancelFunc) {
+	if !f.Enabled {
+		return context.WithCancel(context.Background())
+	}
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// FollowDir reads the rt_*.dat files of dir in order, starting with the most
+// recent one, and waits for new packets until ctx is done.
+func FollowDir(ctx context.Context, dir string, poll time.Duration, d Decoder, fn ErrorHandler) <-chan *TracedPacket {
+	if poll <= 0 {
+		poll = DefaultPoll
+	}
+	q := make(chan *TracedPacket)
+	go func() {
+		defer close(q)
+
+		var (
+			rt    *Reader
+			file  string
+			index int
+		)
+		for ctx.Err() == nil {
+			next := nextFile(dir, file)
+			if next == "" {
+				if !sleep(ctx, poll) {
+					return
+				}
+				continue
+			}
+			file = next
+			err := followFile(ctx, file, poll, func(r io.Reader) error {
+				if rt == nil {
+					rt = NewReader(r, d)
+				} else {
+					rt.Reset(r)
+				}
+				for {
+					p, err := rt.Next()
+					switch err {
+					case nil:
+						t := &TracedPacket{
+							Packet: p,
+							Provenance: Provenance{
+								File:   file,
+								Offset: rt.Offset(),
+								Index:  index,
+							},
+						}
+						select {
+						case q <- t:
+						case <-ctx.Done():
+							return nil
+						}
+						continue
+					case io.EOF:
+						return nil
+					case ErrSkip:
+						continue
+					}
+					if ctx.Err() != nil {
+						return nil
+					}
+					if e, ok := err.(*PacketError); ok {
+						e.File, e.Index = file, index
+						if fn != nil {
+							if err := fn(e); err != nil {
+								return err
+							}
+						}
+						continue
+					}
+					return err
+				}
+			})
+			index++
+			if err != nil && fn != nil {
+				if _, ok := err.(*PacketError); !ok {
+					err = fmt.Errorf("%s: %s", file, err)
+				}
+				if err := fn(err); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return q
+}
+
+func followFile(ctx context.Context, file string, poll time.Duration, fn func(io.Reader) error) error {
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	t := tailReader{
+		ctx:  ctx,
+		file: r,
+		poll: poll,
+		rotated: func() bool {
+			return nextFile(filepath.Dir(file), file) != ""
+		},
+	}
+	return fn(&t)
+}
+
+// nextFile gives the file following file in dir or the most recent one when
+// file is empty.
+func nextFile(dir, file string) string {
+	ms, _ := filepath.Glob(filepath.Join(dir, "rt_*.dat"))
+	if len(ms) == 0 {
+		return ""
+	}
+	sort.Strings(ms)
+	if file == "" {
+		return ms[len(ms)-1]
+	}
+	ix := sort.SearchStrings(ms, file)
+	if ix < len(ms) && ms[ix] == file {
+		ix++
+	}
+	if ix >= len(ms) {
+		return ""
+	}
+	return ms[ix]
+}
+
+// tailReader reads a file being written. At the end of the file, it waits for
+// more data unless a newer file exists.
+type tailReader struct {
+	ctx     context.Context
+	file    *os.File
+	poll    time.Duration
+	rotated func() bool
+}
+
+func (t *tailReader) Read(bs []byte) (int, error) {
+	for {
+		n, err := t.file.Read(bs)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if t.rotated() {
+			if n, _ = t.file.Read(bs); n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		}
+		if !sleep(t.ctx, t.poll) {
+			return 0, io.EOF
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+const (
+	AlertGap     = "gap"
+	AlertError   = "error"
+	AlertLatency = "latency"
+)
+
+type Alert struct {
+	Type    string    `json:"type"`
+	When    time.Time `json:"dtstamp"`
+	Key     string    `json:"key"`
+	Message string    `json:"message"`
+	Source  string    `json:"source,omitempty"`
+}
+
+// Alerter sends alerts to stdout ("log" or "json") or to a webhook (an http
+// URL) where they are posted as JSON. Without target, only latency alerts are
+// printed since gaps and errors are already reported by the commands.
+type Alerter struct {
+	target string
+	queue  chan Alert
+}
+
+// Set selects the target of the alerts. Setting the same target again has no
+// effect; setting another one stops the webhook of the previous target.
+func (a *Alerter) Set(v string) error {
+	v = strings.TrimSpace(v)
+	if v == a.target && (a.queue != nil || !isWebhook(v)) {
+		return nil
+	}
+	switch {
+	case v == "", v == "log", v == "json":
+	case isWebhook(v):
+	default:
+		return fmt.Errorf("unsupported alert target %s", v)
+	}
+	if a.queue != nil {
+		close(a.queue)
+		a.queue = nil
+	}
+	if isWebhook(v) {
+		a.queue = make(chan Alert, 64)
+		go a.post(v, a.queue)
+	}
+	a.target = v
+	return nil
+}
+
+func isWebhook(v string) bool {
+	return strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://")
+}
+
+func (a *Alerter) String() string {
+	return "alert target"
+}
+
+func (a *Alerter) Send(t Alert) {
+	switch a.target {
+	case "":
+		if t.Type == AlertLatency {
+			logAlert(t)
+		}
+	case "log":
+		logAlert(t)
+	case "json":
+		bs, _ := json.Marshal(t)
+		log.Printf("%s", bs)
+	default:
+		select {
+		case a.queue <- t:
+		default:
+			log.Printf("alert dropped (%s): %s", a.target, t.Message)
+		}
+	}
+}
+
+func (a *Alerter) post(url string, queue <-chan Alert) {
+	c := http.Client{Timeout: 5 * time.Second}
+	for t := range queue {
+		bs, _ := json.Marshal(t)
+		rs, err := c.Post(url, "application/json", bytes.NewReader(bs))
+		if err != nil {
+			log.Printf("alert: %s", err)
+			continue
+		}
+		rs.Body.Close()
+		if rs.StatusCode >= http.StatusBadRequest {
+			log.Printf("alert: %s: %s", url, rs.Status)
+		}
+	}
+}
+
+func logAlert(t Alert) {
+	log.Printf("alert | %-7s | %s | %s | %s", t.Type, t.When.Format(TimeFormat), t.Key, t.Message)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultForwardQueue = 1024
+	forwardRetry        = time.Second
+)
+
+const (
+	DropNewest = "newest"
+	DropOldest = "oldest"
+)
+
+// Forwarder sends the packets received by store to a downstream destination.
+// Destinations are given as URLs:
+//
+//	udp://host:port?filter=apid == 1234&queue=4096&drop=oldest
+//
+// Each destination has its own queue. When a queue is full, the incoming packet
+// (drop=newest) or the oldest queued packet (drop=oldest) is dropped so that a
+// slow or unreachable destination never blocks the archiving.
+type Forwarder struct {
+	Proto  string
+	Addr   string
+	Filter Filter
+	Drop   string
+
+	url     string
+	queue   chan []byte
+	done    chan struct{}
+	metrics *Metrics
+
+	state  sync.RWMutex
+	closed bool
+
+	mu      sync.Mutex
+	sent    uint64
+	dropped uint64
+}
+
+func ParseForwarder(str string) (*Forwarder, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return nil, err
+	}
+	f := Forwarder{
+		url:   str,
+		Proto: u.Scheme,
+		Addr:  u.Host,
+		Drop:  DropNewest,
+	}
+	switch f.Proto {
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("%s: unsupported protocol %q", str, f.Proto)
+	}
+	if f.Addr == "" {
+		return nil, fmt.Errorf("%s: no address", str)
+	}
+	q := u.Query()
+	if err := f.Filter.Set(q.Get("filter")); err != nil {
+		return nil, fmt.Errorf("%s: %s", str, err)
+	}
+	size := DefaultForwardQueue
+	if v := q.Get("queue"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size <= 0 {
+			return nil, fmt.Errorf("%s: invalid queue size %s", str, v)
+		}
+	}
+	switch d := strings.ToLower(q.Get("drop")); d {
+	case "", DropNewest:
+	case DropOldest:
+		f.Drop = d
+	default:
+		return nil, fmt.Errorf("%s: unsupported drop policy %s", str, d)
+	}
+	f.queue = make(chan []byte, size)
+	f.done = make(chan struct{})
+	return &f, nil
+}
+
+func (f *Forwarder) String() string {
+	return fmt.Sprintf("%s://%s", f.Proto, f.Addr)
+}
+
+// Push queues bs without ever blocking the caller.
+func (f *Forwarder) Push(bs []byte, p Packet) {
+	if f.Filter.match != nil && (p == nil || !f.Filter.Match(p)) {
+		return
+	}
+	f.state.RLock()
+	defer f.state.RUnlock()
+	if f.closed {
+		return
+	}
+	var vs []byte
+	if f.Proto == "tcp" {
+		// packets sent over TCP are preceded by their size like the ones
+		// read by store.
+		vs = make([]byte, 4+len(bs))
+		binary.LittleEndian.PutUint32(vs, uint32(len(bs)))
+		copy(vs[4:], bs)
+	} else {
+		vs = make([]byte, len(bs))
+		copy(vs, bs)
+	}
+	for {
+		select {
+		case f.queue <- vs:
+			return
+		default:
+		}
+		f.drop()
+		if f.Drop != DropOldest {
+			return
+		}
+		select {
+		case <-f.queue:
+		default:
+		}
+	}
+}
+
+// Run sends the queued packets to the destination, reconnecting when it is not
+// reachable. Once the forwarder is closed, the packets left in the queue are
+// dropped as soon as the destination can not be reached.
+func (f *Forwarder) Run() {
+	defer close(f.done)
+	var (
+		c    net.Conn
+		err  error
+		fail bool
+	)
+	for bs := range f.queue {
+		if c == nil && fail && f.isClosed() {
+			f.drop()
+			continue
+		}
+		if c == nil {
+			if c, err = net.DialTimeout(f.Proto, f.Addr, forwardRetry); err != nil {
+				if !fail {
+					log.Printf("forward %s: %s", f, err)
+				}
+				fail, c = true, nil
+				f.drop()
+				if !f.isClosed() {
+					time.Sleep(forwardRetry)
+				}
+				continue
+			}
+			if fail {
+				log.Printf("forward %s: connected", f)
+			}
+			fail = false
+		}
+		c.SetWriteDeadline(time.Now().Add(forwardRetry))
+		if _, err := c.Write(bs); err != nil {
+			log.Printf("forward %s: %s", f, err)
+			c.Close()
+			c = nil
+			f.drop()
+			continue
+		}
+		f.mu.Lock()
+		f.sent++
+		f.mu.Unlock()
+		f.metrics.Forwarded(f.String(), false)
+	}
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Close stops accepting packets and waits until the queued ones are sent or
+// dropped.
+func (f *Forwarder) Close() {
+	f.state.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.queue)
+	}
+	f.state.Unlock()
+	<-f.done
+}
+
+func (f *Forwarder) isClosed() bool {
+	f.state.RLock()
+	defer f.state.RUnlock()
+	return f.closed
+}
+
+func (f *Forwarder) Stats() (uint64, uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sent, f.dropped
+}
+
+func (f *Forwarder) drop() {
+	f.mu.Lock()
+	f.dropped++
+	f.mu.Unlock()
+	f.metrics.Forwarded(f.String(), true)
+}
+
+type Forwarders []*Forwarder
+
+// Set adds a destination. A destination given more than once is only added
+// the first time so that packets are never sent twice to it.
+func (fs *Forwarders) Set(v string) error {
+	f, err := ParseForwarder(v)
+	if err != nil {
+		return err
+	}
+	for _, x := range *fs {
+		if x.url == f.url {
+			return nil
+		}
+	}
+	*fs = append(*fs, f)
+	return nil
+}
+
+// Close closes every destination, draining their queues.
+func (fs Forwarders) Close() {
+	for _, f := range fs {
+		f.Close()
+	}
+}
+
+func (fs *Forwarders) String() string {
+	return "forward destinations"
+}
+
+// relay writes the data received by store in the archive and then forwards
+// them to the destinations. Data written without their packet are decoded once
+// for the archive and the filters of the destinations.
+type relay struct {
+	io.Writer
+	kind Kind
+	dest Forwarders
+}
+
+func Relay(w io.Writer, k Kind, fs Forwarders, m *Metrics) io.Writer {
+	if len(fs) == 0 {
+		return w
+	}
+	for _, f := range fs {
+		f.metrics = m
+		go f.Run()
+	}
+	return &relay{Writer: w, kind: k, dest: fs}
+}
+
+func (r *relay) Write(bs []byte) (int, error) {
+	p, err := decodeDatagram(r.kind, bs)
+	return r.WritePacket(bs, p, err)
+}
+
+func (r *relay) WritePacket(bs []byte, p Packet, perr error) (int, error) {
+	n, err := writePacket(r.Writer, bs, p, perr)
+	if err != nil {
+		return n, err
+	}
+	for _, f := range r.dest {
+		f.Push(bs, p)
+	}
+	return n, nil
+}
+
+func (r *relay) Report() {
+	const row = "%-21s | %8d | %8d | %6d"
+	for _, f := range r.dest {
+		sent, dropped := f.Stats()
+		log.Printf(row, f, sent, dropped, len(f.queue))
+	}
+}
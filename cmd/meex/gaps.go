@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var gapsCommand = &cli.Command{
+	Usage: "gaps <export|reconcile> [options] <file...>",
+	Short: "create and reconcile playback requests for gaps found in RT file(s)",
+	Run:   runGaps,
+}
+
+func runGaps(cmd *cli.Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("gaps: export or reconcile expected")
+	}
+	switch args[0] {
+	case "export":
+		return runGapsExport(cmd, args[1:])
+	case "reconcile":
+		return runGapsReconcile(cmd, args[1:])
+	default:
+		return fmt.Errorf("gaps: unknown mode %s (export or reconcile expected)", args[0])
+	}
+}
+
+// Request is a playback request covering one or more gaps of the same channel
+// or APID. Starts and Ends give the requested window (padded and clipped),
+// GapStarts and GapEnds the last packet before and the first packet after the
+// missing packets. Times are the ones used to dispatch packets in the archive.
+type Request struct {
+	Id        int       `json:"id"`
+	Key       string    `json:"key"`
+	Starts    time.Time `json:"dtstart"`
+	Ends      time.Time `json:"dtend"`
+	GapStarts time.Time `json:"gapstart"`
+	GapEnds   time.Time `json:"gapend"`
+	Last      int       `json:"last"`
+	First     int       `json:"first"`
+	Gaps      int       `json:"gaps"`
+	Expected  int       `json:"expected"`
+
+	Missing []SequenceRange `json:"missing,omitempty"`
+
+	Found  int    `json:"found,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// SequenceRange gives the sequence counters missing in one gap, Last and First
+// being the counters of the packets found before and after the gap.
+type SequenceRange struct {
+	Last  int `json:"last"`
+	First int `json:"first"`
+}
+
+// Contains reports whether seq is missing in the range. When Last is greater
+// than First, the counter wrapped during the gap.
+func (s SequenceRange) Contains(seq int) bool {
+	if s.Last > s.First {
+		return seq > s.Last || seq < s.First
+	}
+	return seq > s.Last && seq < s.First
+}
+
+// Count gives the number of sequence counters missing in the range.
+func (s SequenceRange) Count() int {
+	if s.Last > s.First {
+		return s.First + sequenceModulus(s.Last) - s.Last - 1
+	}
+	return s.First - s.Last - 1
+}
+
+// sequenceModulus gives the modulus of a counter that wrapped after seq: 14
+// bits for the sequence counters of CCSDS packets, 32 bits for VMU counters.
+func sequenceModulus(seq int) int {
+	if seq <= 0x3FFF {
+		return 0x4000
+	}
+	return 1 << 32
+}
+
+func (s SequenceRange) String() string {
+	return fmt.Sprintf("%d-%d", s.Last, s.First)
+}
+
+func formatSequenceRanges(rs []SequenceRange) string {
+	vs := make([]string, len(rs))
+	for i, r := range rs {
+		vs[i] = r.String()
+	}
+	return strings.Join(vs, " ")
+}
+
+func parseSequenceRanges(str string) ([]SequenceRange, error) {
+	var rs []SequenceRange
+	for _, f := range strings.Fields(str) {
+		x := strings.IndexByte(f[1:], '-') + 1
+		if x <= 0 {
+			return nil, fmt.Errorf("invalid range %s", f)
+		}
+		last, err := strconv.Atoi(f[:x])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %s", f)
+		}
+		first, err := strconv.Atoi(f[x+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %s", f)
+		}
+		rs = append(rs, SequenceRange{Last: last, First: first})
+	}
+	return rs, nil
+}
+
+// Ranges gives the sequence counters missing in the gaps of the request.
+func (r *Request) Ranges() []SequenceRange {
+	if len(r.Missing) == 0 {
+		return []SequenceRange{{Last: r.Last, First: r.First}}
+	}
+	return r.Missing
+}
+
+const (
+	StatusFilled  = "filled"
+	StatusPartial = "partial"
+	StatusMissing = "missing"
+)
+
+func (r *Request) Reconcile() {
+	switch {
+	case r.Found >= r.Expected:
+		r.Status = StatusFilled
+	case r.Found > 0:
+		r.Status = StatusPartial
+	default:
+		r.Status = StatusMissing
+	}
+}
+
+func runGapsExport(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	tolerance := cmd.Flag.Duration("t", 0, "merge gaps separated by less than duration")
+	padding := cmd.Flag.Duration("p", 0, "padding added before and after each request")
+	starts := cmd.Flag.String("s", "", "start time")
+	ends := cmd.Flag.String("e", "", "end time")
+	format := cmd.Flag.String("f", "", "format (csv, json)")
+	file := cmd.Flag.String("o", "", "output file")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	from, to, err := parseWindow(*starts, *ends)
+	if err != nil {
+		return err
+	}
+	var gs []*KeyGap
+	for g := range Gaps(cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle) {
+		gs = append(gs, g)
+	}
+	rs := MergeGaps(gs, *tolerance, *padding, from, to)
+
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := WriteRequests(w, requestFormat(*format, *file), rs); err != nil {
+		return err
+	}
+	var missing int
+	for _, r := range rs {
+		missing += r.Expected
+	}
+	if *file != "" {
+		log.Printf("%d requests from %d gaps (%d missing packets)", len(rs), len(gs), missing)
+	}
+	errs.Summary()
+	return errs.Err()
+}
+
+func runGapsReconcile(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	requests := cmd.Flag.String("r", "", "requests file")
+	file := cmd.Flag.String("o", "", "output file")
+	format := cmd.Flag.String("f", "", "format (csv, json)")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	rs, err := ReadRequests(*requests)
+	if err != nil {
+		return err
+	}
+	ReconcileRequests(rs, WalkTraced(cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle))
+
+	const row = "%4d | %20s | %s | %s | %6d | %6d | %6d | %s"
+	cs := make(map[string]int)
+	for _, r := range rs {
+		cs[r.Status]++
+		log.Printf(row, r.Id, r.Key, r.GapStarts.Format(TimeFormat), r.GapEnds.Format(TimeFormat), r.Last, r.First, r.Found, r.Status)
+	}
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := WriteRequests(f, requestFormat(*format, *file), rs); err != nil {
+			return err
+		}
+	}
+	log.Printf("%d requests: %d filled, %d partial, %d missing", len(rs), cs[StatusFilled], cs[StatusPartial], cs[StatusMissing])
+	errs.Summary()
+	return errs.Err()
+}
+
+// MergeGaps groups the gaps per key and merges the gaps separated by at most
+// tolerance. When from and to are not zero, only the gaps starting in
+// [from, to) are kept and the padding of the requests is clipped to the window,
+// the requests still covering their gaps entirely.
+func MergeGaps(gs []*KeyGap, tolerance, padding time.Duration, from, to time.Time) []*Request {
+	sort.Slice(gs, func(i, j int) bool {
+		if gs[i].Key != gs[j].Key {
+			return gs[i].Key < gs[j].Key
+		}
+		return gs[i].Starts.Before(gs[j].Starts)
+	})
+	var (
+		rs   []*Request
+		curr *Request
+	)
+	shift := GPS.Sub(UNIX)
+	for _, g := range gs {
+		starts, ends := g.Starts.Add(shift), g.Ends.Add(shift)
+		if (!from.IsZero() && starts.Before(from)) || (!to.IsZero() && !starts.Before(to)) {
+			continue
+		}
+		missing := SequenceRange{Last: g.Last, First: g.First}
+		if curr != nil && curr.Key == g.Key && starts.Sub(curr.GapEnds) <= tolerance {
+			if ends.After(curr.GapEnds) {
+				curr.GapEnds, curr.First = ends, g.First
+			}
+			curr.Gaps++
+			curr.Expected += missing.Count()
+			curr.Missing = append(curr.Missing, missing)
+			continue
+		}
+		curr = &Request{
+			Id:        len(rs) + 1,
+			Key:       g.Key,
+			GapStarts: starts,
+			GapEnds:   ends,
+			Last:      g.Last,
+			First:     g.First,
+			Gaps:      1,
+			Expected:  missing.Count(),
+			Missing:   []SequenceRange{missing},
+		}
+		rs = append(rs, curr)
+	}
+	for _, r := range rs {
+		r.Starts, r.Ends = r.GapStarts.Add(-padding), r.GapEnds.Add(padding)
+		if !from.IsZero() && r.Starts.Before(from) {
+			r.Starts = from
+		}
+		if !to.IsZero() && r.Ends.After(to) {
+			r.Ends = to
+			if r.Ends.Before(r.GapEnds) {
+				r.Ends = r.GapEnds
+			}
+		}
+	}
+	return rs
+}
+
+// ReconcileRequests counts the distinct packets found in queue that are part
+// of the gaps of the requests: packets between the gaps of merged requests
+// were already available and are not counted.
+func ReconcileRequests(rs []*Request, queue <-chan *TracedPacket) {
+	type seen struct {
+		id       int
+		sequence int
+	}
+	var (
+		keys  = make(map[string][]*Request)
+		found = make(map[seen]struct{})
+	)
+	for _, r := range rs {
+		keys[r.Key] = append(keys[r.Key], r)
+		r.Found = 0
+	}
+	for _, vs := range keys {
+		sort.Slice(vs, func(i, j int) bool { return vs[i].GapStarts.Before(vs[j].GapStarts) })
+	}
+	for p := range queue {
+		vs := keys[defaultPacketKey(p.Packet)]
+		if len(vs) == 0 {
+			continue
+		}
+		t := p.Timestamp().Add(GPS.Sub(UNIX))
+		ix := sort.Search(len(vs), func(i int) bool { return !vs[i].GapStarts.Before(t) })
+		for i := ix - 1; i >= 0; i-- {
+			r := vs[i]
+			if !t.After(r.GapStarts) || !t.Before(r.GapEnds) || !inRanges(r.Ranges(), p.Sequence()) {
+				if t.Sub(r.GapStarts) > Day {
+					break
+				}
+				continue
+			}
+			k := seen{id: r.Id, sequence: p.Sequence()}
+			if _, ok := found[k]; !ok {
+				found[k] = struct{}{}
+				r.Found++
+			}
+			break
+		}
+	}
+	for _, r := range rs {
+		r.Reconcile()
+	}
+}
+
+func inRanges(rs []SequenceRange, seq int) bool {
+	for _, r := range rs {
+		if r.Contains(seq) {
+			return true
+		}
+	}
+	return false
+}
+
+var requestHeaders = []string{
+	"id",
+	"key",
+	"dtstart",
+	"dtend",
+	"gapstart",
+	"gapend",
+	"last",
+	"first",
+	"gaps",
+	"expected",
+	"missing",
+	"found",
+	"status",
+}
+
+func requestFormat(format, file string) string {
+	if format != "" {
+		return strings.ToLower(format)
+	}
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		return "json"
+	}
+	return "csv"
+}
+
+func WriteRequests(w io.Writer, format string, rs []*Request) error {
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		if rs == nil {
+			rs = []*Request{}
+		}
+		return e.Encode(rs)
+	case "csv", "":
+		ws := csv.NewWriter(w)
+		ws.Write(requestHeaders)
+		for _, r := range rs {
+			rec := []string{
+				strconv.Itoa(r.Id),
+				r.Key,
+				r.Starts.Format(time.RFC3339Nano),
+				r.Ends.Format(time.RFC3339Nano),
+				r.GapStarts.Format(time.RFC3339Nano),
+				r.GapEnds.Format(time.RFC3339Nano),
+				strconv.Itoa(r.Last),
+				strconv.Itoa(r.First),
+				strconv.Itoa(r.Gaps),
+				strconv.Itoa(r.Expected),
+				formatSequenceRanges(r.Missing),
+				strconv.Itoa(r.Found),
+				r.Status,
+			}
+			if err := ws.Write(rec); err != nil {
+				return err
+			}
+		}
+		ws.Flush()
+		return ws.Error()
+	default:
+		return fmt.Errorf("unsupported format %s", format)
+	}
+}
+
+func ReadRequests(file string) ([]*Request, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if bs, err := r.Peek(1); err == nil && bs[0] == '[' {
+		var rs []*Request
+		if err := json.NewDecoder(r).Decode(&rs); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return rs, nil
+	}
+	rs, err := readRequestsCSV(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return rs, nil
+}
+
+func readRequestsCSV(r io.Reader) ([]*Request, error) {
+	rs := csv.NewReader(r)
+	rs.FieldsPerRecord = -1
+	head, err := rs.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]int)
+	for i, h := range head {
+		cols[strings.TrimSpace(h)] = i
+	}
+	for _, h := range requestHeaders[:10] {
+		if _, ok := cols[h]; !ok {
+			return nil, fmt.Errorf("missing column %s", h)
+		}
+	}
+	var vs []*Request
+	for {
+		rec, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var (
+			r   Request
+			ps  = []*int{&r.Id, &r.Last, &r.First, &r.Gaps, &r.Expected}
+			ns  = []string{"id", "last", "first", "gaps", "expected"}
+			ts  = []*time.Time{&r.Starts, &r.Ends, &r.GapStarts, &r.GapEnds}
+			tns = []string{"dtstart", "dtend", "gapstart", "gapend"}
+		)
+		get := func(n string) string {
+			if i, ok := cols[n]; ok && i < len(rec) {
+				return rec[i]
+			}
+			return ""
+		}
+		r.Key = get("key")
+		for i, n := range ns {
+			if *ps[i], err = strconv.Atoi(get(n)); err != nil {
+				return nil, fmt.Errorf("%s: %s", n, err)
+			}
+		}
+		for i, n := range tns {
+			if *ts[i], err = time.Parse(time.RFC3339Nano, get(n)); err != nil {
+				return nil, fmt.Errorf("%s: %s", n, err)
+			}
+		}
+		if r.Missing, err = parseSequenceRanges(get("missing")); err != nil {
+			return nil, fmt.Errorf("missing: %s", err)
+		}
+		vs = append(vs, &r)
+	}
+	return vs, nil
+}
+
+func parseWindow(starts, ends string) (time.Time, time.Time, error) {
+	var (
+		from, to time.Time
+		err      error
+	)
+	if starts != "" {
+		if from, err = time.Parse(time.RFC3339, starts); err != nil {
+			return from, to, err
+		}
+	}
+	if ends != "" {
+		if to, err = time.Parse(time.RFC3339, ends); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeGaps(t *testing.T) {
+	var (
+		base  = time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+		shift = GPS.Sub(UNIX)
+	)
+	gap := func(key string, last, first int) *KeyGap {
+		g := Gap{
+			Starts: base.Add(time.Duration(last) * time.Second).Add(-shift),
+			Ends:   base.Add(time.Duration(first) * time.Second).Add(-shift),
+			Last:   last,
+			First:  first,
+		}
+		return &KeyGap{Gap: &g, Key: key}
+	}
+	wrapped := func(key string, last, first int) *KeyGap {
+		g := Gap{
+			Starts: base.Add(-shift),
+			Ends:   base.Add(3 * time.Second).Add(-shift),
+			Last:   last,
+			First:  first,
+		}
+		return &KeyGap{Gap: &g, Key: key}
+	}
+	at := func(sec int) time.Time {
+		return base.Add(time.Duration(sec) * time.Second)
+	}
+	type request struct {
+		Key      string
+		Starts   time.Time
+		Ends     time.Time
+		Gaps     int
+		Expected int
+		Missing  int
+	}
+	data := []struct {
+		Name      string
+		Gaps      []*KeyGap
+		Tolerance time.Duration
+		Padding   time.Duration
+		From      time.Time
+		To        time.Time
+		Want      []request
+	}{
+		{
+			Name: "single",
+			Gaps: []*KeyGap{gap("a", 2, 5)},
+			Want: []request{
+				{Key: "a", Starts: at(2), Ends: at(5), Gaps: 1, Expected: 2, Missing: 1},
+			},
+		},
+		{
+			Name:      "merged",
+			Gaps:      []*KeyGap{gap("a", 6, 9), gap("a", 2, 5)},
+			Tolerance: time.Second,
+			Padding:   time.Second,
+			Want: []request{
+				{Key: "a", Starts: at(1), Ends: at(10), Gaps: 2, Expected: 4, Missing: 2},
+			},
+		},
+		{
+			Name:      "beyond tolerance",
+			Gaps:      []*KeyGap{gap("a", 2, 5), gap("a", 12, 30)},
+			Tolerance: 2 * time.Second,
+			Want: []request{
+				{Key: "a", Starts: at(2), Ends: at(5), Gaps: 1, Expected: 2, Missing: 1},
+				{Key: "a", Starts: at(12), Ends: at(30), Gaps: 1, Expected: 17, Missing: 1},
+			},
+		},
+		{
+			Name:      "keys",
+			Gaps:      []*KeyGap{gap("b", 2, 5), gap("a", 6, 9)},
+			Tolerance: time.Minute,
+			Want: []request{
+				{Key: "a", Starts: at(6), Ends: at(9), Gaps: 1, Expected: 2, Missing: 1},
+				{Key: "b", Starts: at(2), Ends: at(5), Gaps: 1, Expected: 2, Missing: 1},
+			},
+		},
+		{
+			Name:    "clipped",
+			Gaps:    []*KeyGap{gap("a", 2, 5), gap("a", 12, 30), gap("a", 40, 50)},
+			Padding: 5 * time.Second,
+			From:    at(10),
+			To:      at(40),
+			Want: []request{
+				{Key: "a", Starts: at(10), Ends: at(35), Gaps: 1, Expected: 17, Missing: 1},
+			},
+		},
+		{
+			Name:    "across window end",
+			Gaps:    []*KeyGap{gap("a", 8, 12), gap("a", 35, 50)},
+			Padding: 5 * time.Second,
+			From:    at(10),
+			To:      at(40),
+			Want: []request{
+				{Key: "a", Starts: at(30), Ends: at(50), Gaps: 1, Expected: 14, Missing: 1},
+			},
+		},
+		{
+			Name: "wrapped",
+			Gaps: []*KeyGap{wrapped("a", 16382, 1)},
+			Want: []request{
+				{Key: "a", Starts: at(0), Ends: at(3), Gaps: 1, Expected: 2, Missing: 1},
+			},
+		},
+	}
+	for _, d := range data {
+		rs := MergeGaps(d.Gaps, d.Tolerance, d.Padding, d.From, d.To)
+		if len(rs) != len(d.Want) {
+			t.Errorf("%s: want %d requests, got %d", d.Name, len(d.Want), len(rs))
+			continue
+		}
+		for i, r := range rs {
+			got := request{
+				Key:      r.Key,
+				Starts:   r.Starts,
+				Ends:     r.Ends,
+				Gaps:     r.Gaps,
+				Expected: r.Expected,
+				Missing:  len(r.Missing),
+			}
+			if want := d.Want[i]; got != want {
+				t.Errorf("%s: request %d: want %+v, got %+v", d.Name, i, want, got)
+			}
+			if r.Id != i+1 {
+				t.Errorf("%s: request %d: unexpected id %d", d.Name, i, r.Id)
+			}
+		}
+	}
+}
+
+func TestSequenceRangeContains(t *testing.T) {
+	data := []struct {
+		Range SequenceRange
+		Seq   int
+		Want  bool
+	}{
+		{Range: SequenceRange{Last: 2, First: 5}, Seq: 3, Want: true},
+		{Range: SequenceRange{Last: 2, First: 5}, Seq: 2, Want: false},
+		{Range: SequenceRange{Last: 2, First: 5}, Seq: 5, Want: false},
+		{Range: SequenceRange{Last: 16382, First: 1}, Seq: 16383, Want: true},
+		{Range: SequenceRange{Last: 16382, First: 1}, Seq: 0, Want: true},
+		{Range: SequenceRange{Last: 16382, First: 1}, Seq: 1, Want: false},
+		{Range: SequenceRange{Last: 16382, First: 1}, Seq: 100, Want: false},
+	}
+	for _, d := range data {
+		if got := d.Range.Contains(d.Seq); got != d.Want {
+			t.Errorf("%s: %d: want %t, got %t", d.Range, d.Seq, d.Want, got)
+		}
+	}
+}
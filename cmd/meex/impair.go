@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/busoc/timutil"
+	"github.com/midbel/cli"
+	"github.com/midbel/toml"
+)
+
+var impairCommand = &cli.Command{
+	Usage: "impair [-k type] [-p profile] [-l log] [-seed seed] <source> [<target>]",
+	Short: "simulate network impairments on packets from a RT file",
+	Run:   runImpair,
+}
+
+const (
+	ImpairLoss      = "loss"
+	ImpairBurst     = "burst"
+	ImpairDuplicate = "duplicate"
+	ImpairReorder   = "reorder"
+	ImpairCorrupt   = "corrupt"
+	ImpairTruncate  = "truncate"
+	ImpairJitter    = "jitter"
+)
+
+// Profile describes the impairments applied by impair. Probabilities are given
+// per packet:
+//
+//	loss      = 0.001
+//	duplicate = 0.002
+//	truncate  = 0.0005
+//	jitter    = "250ms"
+//
+//	[burst]
+//	enter = 0.0001
+//	leave = 0.1
+//	loss  = 0.9
+//
+//	[reorder]
+//	rate   = 0.01
+//	window = 16
+//
+//	[corrupt]
+//	rate = 0.001
+//	bits = 2
+//
+// Losses follow a Gilbert-Elliott model: in the good state, packets are lost
+// with the loss probability; the burst section gives the probabilities to enter
+// and leave the bad state and the loss probability in the bad state.
+type Profile struct {
+	Loss      float64 `toml:"loss"`
+	Duplicate float64 `toml:"duplicate"`
+	Truncate  float64 `toml:"truncate"`
+	Jitter    string  `toml:"jitter"`
+	Burst     Burst   `toml:"burst"`
+	Reorder   Reorder `toml:"reorder"`
+	Corrupt   Corrupt `toml:"corrupt"`
+
+	jitter time.Duration
+}
+
+type Burst struct {
+	Enter float64 `toml:"enter"`
+	Leave float64 `toml:"leave"`
+	Loss  float64 `toml:"loss"`
+}
+
+type Reorder struct {
+	Rate   float64 `toml:"rate"`
+	Window int     `toml:"window"`
+}
+
+type Corrupt struct {
+	Rate float64 `toml:"rate"`
+	Bits int     `toml:"bits"`
+}
+
+func LoadProfile(file string) (*Profile, error) {
+	var p Profile
+	if err := toml.DecodeFile(file, &p); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &p, nil
+}
+
+func (p *Profile) check() error {
+	ps := []struct {
+		Name  string
+		Value float64
+	}{
+		{"loss", p.Loss},
+		{"duplicate", p.Duplicate},
+		{"truncate", p.Truncate},
+		{"burst.enter", p.Burst.Enter},
+		{"burst.leave", p.Burst.Leave},
+		{"burst.loss", p.Burst.Loss},
+		{"reorder.rate", p.Reorder.Rate},
+		{"corrupt.rate", p.Corrupt.Rate},
+	}
+	for _, v := range ps {
+		if v.Value < 0 || v.Value > 1 {
+			return fmt.Errorf("%s: probability should be between 0 and 1 (got %f)", v.Name, v.Value)
+		}
+	}
+	if p.Reorder.Rate > 0 && p.Reorder.Window <= 0 {
+		return fmt.Errorf("reorder: window should be positive")
+	}
+	if p.Corrupt.Bits <= 0 {
+		p.Corrupt.Bits = 1
+	}
+	if p.Jitter != "" {
+		d, err := time.ParseDuration(p.Jitter)
+		if err != nil || d < 0 {
+			return fmt.Errorf("jitter: invalid duration %s", p.Jitter)
+		}
+		p.jitter = d
+	}
+	return nil
+}
+
+func runImpair(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	file := cmd.Flag.String("p", "", "impairment profile")
+	truth := cmd.Flag.String("l", "", "write ground truth to file")
+	seed := cmd.Flag.Int64("seed", 0, "random seed")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	if *file == "" {
+		return fmt.Errorf("no impairment profile provided")
+	}
+	p, err := LoadProfile(*file)
+	if err != nil {
+		return err
+	}
+
+	var r io.ReadCloser = os.Stdin
+	if f := cmd.Flag.Arg(0); f != "" && f != "-" {
+		if r, err = OpenFile(f); err != nil {
+			return err
+		}
+	}
+	defer r.Close()
+
+	var w io.WriteCloser = os.Stdout
+	if f := cmd.Flag.Arg(1); f != "" && f != "-" {
+		if w, err = CreateFile(f); err != nil {
+			return err
+		}
+	}
+	defer w.Close()
+
+	var tw io.Writer = ioutil.Discard
+	if *truth != "" {
+		f, err := os.Create(*truth)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		tw = f
+	}
+
+	m := Impair(w, tw, kind, *p, seedRand(*seed))
+	s := Scan(r)
+	for s.Scan() {
+		if err := m.Write(s.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if err := m.Flush(); err != nil {
+		return err
+	}
+	m.Report()
+	return w.Close()
+}
+
+// Impairer applies an impairment profile to the packets written to it. Every
+// impairment is recorded in the ground truth as a CSV row giving the index of
+// the packet in the source, its id, sequence counter and timestamp, the
+// impairment and its detail.
+type Impairer struct {
+	Profile
+
+	kind  Kind
+	rand  *rand.Rand
+	inner io.Writer
+	truth *csv.Writer
+
+	bad   bool
+	index int
+	held  []*heldPacket
+	stats map[string]int
+}
+
+type heldPacket struct {
+	bs   []byte
+	wait int
+}
+
+func Impair(w, truth io.Writer, k Kind, p Profile, rng *rand.Rand) *Impairer {
+	m := Impairer{
+		Profile: p,
+		kind:    k,
+		rand:    rng,
+		inner:   w,
+		truth:   csv.NewWriter(truth),
+		stats:   make(map[string]int),
+	}
+	m.truth.Write([]string{"index", "id", "sequence", "dtstamp", "impairment", "detail"})
+	return &m
+}
+
+// Write impairs one packet of the source, bs being the packet with its RT
+// frame.
+func (m *Impairer) Write(bs []byte) error {
+	m.index++
+	p, _ := m.kind.Decod.Decode(bs)
+
+	if m.lost() {
+		t := ImpairLoss
+		if m.bad {
+			t = ImpairBurst
+		}
+		m.record(p, t, "")
+		return nil
+	}
+	vs := make([]byte, len(bs))
+	copy(vs, bs)
+
+	if m.jitter > 0 {
+		vs = m.delay(p, vs)
+	}
+	if m.Truncate > 0 && m.rand.Float64() < m.Truncate {
+		vs = m.truncate(p, vs)
+	}
+	if m.Corrupt.Rate > 0 && m.rand.Float64() < m.Corrupt.Rate {
+		vs = m.corrupt(p, vs)
+	}
+	if m.Reorder.Rate > 0 && m.rand.Float64() < m.Reorder.Rate {
+		n := 1 + m.rand.Intn(m.Reorder.Window)
+		m.held = append(m.held, &heldPacket{bs: vs, wait: n})
+		m.record(p, ImpairReorder, fmt.Sprintf("delayed by %d packets", n))
+	} else if err := m.emit(vs); err != nil {
+		return err
+	}
+	if m.Duplicate > 0 && m.rand.Float64() < m.Duplicate {
+		m.record(p, ImpairDuplicate, "")
+		return m.emit(vs)
+	}
+	return nil
+}
+
+// Flush writes the packets still delayed by reordering.
+func (m *Impairer) Flush() error {
+	for _, h := range m.held {
+		if _, err := m.inner.Write(h.bs); err != nil {
+			return err
+		}
+	}
+	m.held = m.held[:0]
+	m.truth.Flush()
+	return m.truth.Error()
+}
+
+func (m *Impairer) Report() {
+	log.Printf("%d packets read", m.index)
+	for _, t := range []string{ImpairLoss, ImpairBurst, ImpairDuplicate, ImpairReorder, ImpairCorrupt, ImpairTruncate, ImpairJitter} {
+		if n := m.stats[t]; n > 0 {
+			log.Printf("%-9s | %8d | %6.3f%%", t, n, float64(n)*100/float64(m.index))
+		}
+	}
+}
+
+func (m *Impairer) lost() bool {
+	if m.Burst.Enter > 0 {
+		if m.bad {
+			m.bad = m.rand.Float64() >= m.Burst.Leave
+		} else {
+			m.bad = m.rand.Float64() < m.Burst.Enter
+		}
+	}
+	loss := m.Loss
+	if m.bad {
+		loss = m.Burst.Loss
+	}
+	return loss > 0 && m.rand.Float64() < loss
+}
+
+func (m *Impairer) emit(bs []byte) error {
+	if _, err := m.inner.Write(bs); err != nil {
+		return err
+	}
+	var j int
+	for _, h := range m.held {
+		if h.wait--; h.wait > 0 {
+			m.held[j] = h
+			j++
+			continue
+		}
+		if _, err := m.inner.Write(h.bs); err != nil {
+			return err
+		}
+	}
+	m.held = m.held[:j]
+	return nil
+}
+
+// Offsets of the 5 bytes times (coarse and fine) of the headers written in
+// front of the packets by store.
+const (
+	pthReceptionOffset    = 5  // PTH: size (4), type (1), reception
+	hrdlAcquisitionOffset = 8  // HRDL: size (4), error (2), payload (1), channel (1), acquisition
+	hrdlReceptionOffset   = 13 // HRDL: followed by reception
+)
+
+// delay moves the reception time of TM and VMU packets by a random duration
+// up to the jitter of the profile. For TM packets, the reception time of the
+// PTH header is moved. For VMU packets, both times of the HRDL header are
+// moved: the acquisition time, given as reception time of the packet by meex,
+// and the reception time. The times of the packets themselves (CCSDS/ESA or VMU
+// headers) are never modified.
+func (m *Impairer) delay(p Packet, bs []byte) []byte {
+	var offsets []int
+	switch p.(type) {
+	case *TMPacket:
+		offsets = []int{pthReceptionOffset}
+	case *VMUPacket:
+		offsets = []int{hrdlAcquisitionOffset, hrdlReceptionOffset}
+	default:
+		return bs
+	}
+	if len(bs) < offsets[len(offsets)-1]+5 {
+		return bs
+	}
+	d := time.Duration(m.rand.Int63n(int64(m.jitter) + 1))
+	for _, o := range offsets {
+		t := timutil.Join5(binary.BigEndian.Uint32(bs[o:]), bs[o+4])
+		c, f := timutil.Split5(t.Add(d))
+		binary.BigEndian.PutUint32(bs[o:], c)
+		bs[o+4] = byte(f)
+	}
+	m.record(p, ImpairJitter, d.String())
+	return bs
+}
+
+// truncate cuts the packet somewhere in its payload. The RT frame is updated
+// so that following packets can still be read.
+func (m *Impairer) truncate(p Packet, bs []byte) []byte {
+	offset := payloadOffset(p, m.kind)
+	if offset >= len(bs)-1 {
+		return bs
+	}
+	n := offset + m.rand.Intn(len(bs)-offset)
+	binary.LittleEndian.PutUint32(bs, uint32(n-4))
+
+	m.record(p, ImpairTruncate, fmt.Sprintf("%d/%d bytes", n, len(bs)))
+	return bs[:n]
+}
+
+// corrupt flips bits in the payload of the packet, leaving its headers intact
+// so that the packet is still identified but fails its checksum.
+func (m *Impairer) corrupt(p Packet, bs []byte) []byte {
+	offset := payloadOffset(p, m.kind)
+	if offset >= len(bs) {
+		return bs
+	}
+	var detail string
+	for i := 0; i < m.Corrupt.Bits; i++ {
+		bit := m.rand.Intn((len(bs) - offset) * 8)
+		bs[offset+bit/8] ^= 1 << uint(bit%8)
+		if i > 0 {
+			detail += " "
+		}
+		detail += strconv.Itoa(offset*8 + bit)
+	}
+	m.record(p, ImpairCorrupt, "bits "+detail)
+	return bs
+}
+
+func (m *Impairer) record(p Packet, t, detail string) {
+	m.stats[t]++
+
+	row := []string{strconv.Itoa(m.index), "", "", "", t, detail}
+	if p != nil {
+		id, _ := p.Id()
+		row[1] = strconv.Itoa(id)
+		row[2] = strconv.Itoa(p.Sequence())
+		row[3] = p.Timestamp().Format(time.RFC3339Nano)
+	}
+	m.truth.Write(row)
+}
+
+// payloadOffset gives the offset of the user data in a packet with its RT
+// frame.
+func payloadOffset(p Packet, k Kind) int {
+	switch p.(type) {
+	case *TMPacket:
+		return PTHHeaderLen + CCSDSHeaderLen + ESAHeaderLen
+	case *CCSDSPacket:
+		return 4 + CCSDSHeaderLen + ESAHeaderLen
+	case *VMUPacket, HRPacket:
+		return HRDLHeaderLen + VMUHeaderLen
+	case *PDPacket:
+		return 4 + UMIHeaderLen
+	default:
+		return 4 + k.Header
+	}
+}
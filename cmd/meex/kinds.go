@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/midbel/linewriter"
+)
+
+type PrintFunc func(*linewriter.Writer, Packet, *Gap, time.Duration) bool
+
+type KeyFunc func(Packet) (string, bool)
+
+type FrameFunc func([]byte) ([]byte, error)
+
+type Kind struct {
+	Name    string
+	Aliases []string
+
+	Decod  Decoder
+	Sort   SortFunc
+	Header int
+	Frame  FrameFunc
+	Print  PrintFunc
+	Key    KeyFunc
+}
+
+var registry = struct {
+	kinds []*Kind
+	names map[string]*Kind
+}{
+	names: make(map[string]*Kind),
+}
+
+func RegisterKind(k Kind) {
+	if k.Name == "" || k.Decod == nil {
+		panic("register kind: name and decoder are required")
+	}
+	for _, n := range append([]string{k.Name}, k.Aliases...) {
+		n = strings.ToLower(n)
+		if _, ok := registry.names[n]; ok {
+			panic(fmt.Sprintf("register kind: %s already registered", n))
+		}
+		registry.names[n] = &k
+	}
+	registry.kinds = append(registry.kinds, &k)
+}
+
+func LookupKind(n string) (*Kind, error) {
+	if n == "" {
+		return nil, fmt.Errorf("no packet type provided")
+	}
+	k, ok := registry.names[strings.ToLower(n)]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized packet decoder type %s (available: %s)", n, strings.Join(KindNames(), ", "))
+	}
+	return k, nil
+}
+
+// kindName gives the name of the kind registered under n, or n itself when no
+// kind is registered under it.
+func kindName(n string) string {
+	if k, ok := registry.names[strings.ToLower(n)]; ok {
+		return k.Name
+	}
+	return n
+}
+
+func KindNames() []string {
+	ns := make([]string, 0, len(registry.kinds))
+	for _, k := range registry.kinds {
+		ns = append(ns, k.Name)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+func (k *Kind) Set(v string) error {
+	r, err := LookupKind(v)
+	if err != nil {
+		return err
+	}
+	*k = *r
+	return nil
+}
+
+func (k *Kind) String() string {
+	return "packet decoder type"
+}
+
+func printPacket(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) bool {
+	for _, k := range registry.kinds {
+		if k.Print != nil && k.Print(line, p, g, delta) {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultPacketKey(p Packet) string {
+	for _, k := range registry.kinds {
+		if k.Key == nil {
+			continue
+		}
+		if s, ok := k.Key(p); ok {
+			return s
+		}
+	}
+	i, _ := p.Id()
+	return fmt.Sprint(i)
+}
+
+func init() {
+	RegisterKind(Kind{
+		Name:    "pd",
+		Aliases: []string{"pp", "pdh"},
+		Decod:   DecodePD(),
+		Header:  UMIHeaderLen,
+		Frame:   storePDH,
+		Print: func(line *linewriter.Writer, p Packet, _ *Gap, delta time.Duration) bool {
+			v, ok := p.(*PDPacket)
+			return ok && printPDPacket(line, v, delta)
+		},
+		Key: func(p Packet) (string, bool) {
+			v, ok := p.(*PDPacket)
+			if !ok {
+				return "", false
+			}
+			return fmt.Sprintf("0x%x", v.UMI.Code[:]), true
+		},
+	})
+	RegisterKind(Kind{
+		Name:    "tm",
+		Aliases: []string{"pth", "pt"},
+		Decod:   DecodeTM(),
+		Sort:    SortTMIndex,
+		Header:  PTHHeaderLen,
+		Frame:   storePTH,
+		Print: func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) bool {
+			v, ok := p.(*TMPacket)
+			return ok && printTMPacket(line, v, g, delta)
+		},
+		Key: func(p Packet) (string, bool) {
+			v, ok := p.(*TMPacket)
+			if !ok {
+				return "", false
+			}
+			return fmt.Sprint(v.CCSDS.Apid()), true
+		},
+	})
+	RegisterKind(Kind{
+		Name:    "vmu",
+		Aliases: []string{"hrdl"},
+		Decod:   DecodeVMU(),
+		Sort:    SortHRDIndex,
+		Header:  HRDLHeaderLen,
+		Frame:   storeVMU,
+		Print: func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) bool {
+			v, ok := p.(*VMUPacket)
+			return ok && printVMUPacket(line, v, g, delta)
+		},
+		Key: func(p Packet) (string, bool) {
+			v, ok := p.(*VMUPacket)
+			if !ok {
+				return "", false
+			}
+			return fmt.Sprintf("%s/%s", v.VMU.Channel, streamLabel(v)), true
+		},
+	})
+	RegisterKind(Kind{
+		Name:   "hrd",
+		Decod:  DecodeHRD(),
+		Header: HRDLHeaderLen,
+		Key: func(p Packet) (string, bool) {
+			v, ok := p.(HRPacket)
+			if !ok {
+				return "", false
+			}
+			i, _ := v.Id()
+			return fmt.Sprintf("%x/%s/%s/%s", i, v.Type(), v.String(), streamLabel(v)), true
+		},
+	})
+}
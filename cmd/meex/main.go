@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime/debug"
 	"sort"
 	"strings"
 
@@ -26,6 +27,16 @@ var commands = []*cli.Command{
 	countCommand,
 	errCommand,
 	storeCommand,
+	auditCommand,
+	manifestCommand,
+	assembleCommand,
+	paramsCommand,
+	serveCommand,
+	gapsCommand,
+	syncCommand,
+	impairCommand,
+	splitCommand,
+	catCommand,
 }
 
 const helpText = `{{.Name}} scan the HRDP archive to consolidate the USOC HRDP archive
@@ -38,14 +49,18 @@ Available commands:
 
 {{range .Commands}}{{if .Runnable}}{{printf "  %-12s %s" .String .Short}}{{if .Alias}} (alias: {{ join .Alias ", "}}){{end}}{{end}}
 {{end}}
+Every command accepts -config to load a configuration file (default: $MEEX_CONFIG
+or meex.toml in the user configuration directory or /etc/meex) and -archive to
+select one of the archives it defines.
+
+Compressed files (gz, zst, xz) are accepted everywhere. Commands that need to
+seek in their inputs (sort, merge, shuffle, sync and dispatch when it merges
+with existing files) decompress them fully in memory: give them plain files
+when they do not fit in memory.
+
 Use {{.Name}} [command] -h for more information about its usage.
 `
 
-type Kind struct {
-	Decod Decoder
-	Sort  SortFunc
-}
-
 func SortHRDIndex(ix []*Index) []*Index {
 	sort.Slice(ix, func(i, j int) bool {
 		if ix[i].Timestamp.Equal(ix[j].Timestamp) {
@@ -70,28 +85,48 @@ func SortTMIndex(ix []*Index) []*Index {
 	return ix
 }
 
-func (k *Kind) Set(v string) error {
+type Stream uint8
+
+const (
+	StreamAny Stream = iota
+	StreamRealtime
+	StreamPlayback
+)
+
+func (s *Stream) Set(v string) error {
 	switch strings.ToLower(v) {
 	default:
-		return fmt.Errorf("unrecognized packet decoder type")
-	case "":
-		return fmt.Errorf("no packet type provided")
-	case "pd", "pp", "pdh":
-		k.Decod = DecodePD()
-	case "tm", "pth", "pt":
-		k.Decod = DecodeTM()
-		k.Sort = SortTMIndex
-	case "vmu":
-		k.Decod = DecodeVMU()
-		k.Sort = SortHRDIndex
-	case "hrd":
-		k.Decod = DecodeHRD()
+		return fmt.Errorf("unrecognized stream %s", v)
+	case "", "all", "any":
+		*s = StreamAny
+	case "realtime", "rt":
+		*s = StreamRealtime
+	case "playback", "pb":
+		*s = StreamPlayback
 	}
 	return nil
 }
 
-func (k *Kind) String() string {
-	return "packet decoder type"
+func (s *Stream) String() string {
+	switch *s {
+	case StreamRealtime:
+		return "realtime"
+	case StreamPlayback:
+		return "playback"
+	default:
+		return "all"
+	}
+}
+
+func (s Stream) Accept(p Packet) bool {
+	if s == StreamAny {
+		return true
+	}
+	if _, ok := p.(Realtimer); !ok {
+		return true
+	}
+	rt, ok := streamOf(p)
+	return ok && rt == (s == StreamRealtime)
 }
 
 func init() {
@@ -105,8 +140,23 @@ func init() {
 func main() {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Fatalf("unexpected error: %s", err)
+			fmt.Fprintf(os.Stderr, "unexpected error: %s\n%s", err, debug.Stack())
+			os.Exit(ExitPanic)
 		}
 	}()
+	for _, c := range commands {
+		c.Run = withExitCode(c.Run)
+	}
 	cli.RunAndExit(commands, cli.Usage("meex", helpText, commands))
 }
+
+func withExitCode(run func(*cli.Command, []string) error) func(*cli.Command, []string) error {
+	return func(cmd *cli.Command, args []string) error {
+		err := run(cmd, args)
+		if e, ok := err.(*ExitError); ok {
+			fmt.Fprintln(os.Stderr, e)
+			os.Exit(e.Code)
+		}
+		return err
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var manifestCommand = &cli.Command{
+	Usage: "manifest [-k type] [-d algorithm] [-o file] <archive> | manifest verify [-k type] <manifest> <archive>",
+	Short: "create or verify a manifest of the files of a RT archive",
+	Run:   runManifest,
+}
+
+const DefaultDigest = "sha256"
+
+const (
+	ManifestAdded     = "added"
+	ManifestRemoved   = "removed"
+	ManifestModified  = "modified"
+	ManifestTruncated = "truncated"
+)
+
+type Entry struct {
+	File   string
+	Size   int64
+	Count  int
+	Starts time.Time
+	Ends   time.Time
+	Sum    string
+}
+
+func (e *Entry) Record() []string {
+	return []string{
+		e.File,
+		strconv.FormatInt(e.Size, 10),
+		strconv.Itoa(e.Count),
+		formatManifestTime(e.Starts),
+		formatManifestTime(e.Ends),
+		e.Sum,
+	}
+}
+
+func runManifest(cmd *cli.Command, args []string) error {
+	if len(args) > 0 && args[0] == "verify" {
+		return runManifestVerify(cmd, args[1:])
+	}
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	digest := cmd.Flag.String("d", DefaultDigest, "digest")
+	file := cmd.Flag.String("o", "", "manifest file")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if _, err := NewDigest(*digest); err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	ws := csv.NewWriter(w)
+	ws.Write([]string{"path", "size", "packets", "dtstart", "dtend", *digest})
+
+	var (
+		count int
+		size  int64
+		now   = time.Now()
+	)
+	root := cmd.Flag.Arg(0)
+	err := walkManifest(root, kind.Decod, *digest, func(e *Entry) error {
+		count++
+		size += e.Size
+		return ws.Write(e.Record())
+	})
+	if err != nil {
+		return err
+	}
+	ws.Flush()
+	if err := ws.Error(); err != nil {
+		return err
+	}
+	if *file != "" {
+		log.Printf("%d files (%dMB) written to %s (%s)", count, size>>20, *file, time.Since(now))
+	}
+	return nil
+}
+
+func runManifestVerify(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	const row = "%-64s | %-10s | %s"
+
+	digest, es, err := readManifest(cmd.Flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	var (
+		diff  int
+		count int
+		now   = time.Now()
+	)
+	err = walkManifest(cmd.Flag.Arg(1), kind.Decod, digest, func(e *Entry) error {
+		count++
+		o, ok := es[e.File]
+		if !ok {
+			diff++
+			log.Printf(row, e.File, ManifestAdded, fmt.Sprintf("%d bytes, %d packets", e.Size, e.Count))
+			return nil
+		}
+		delete(es, e.File)
+		switch {
+		case e.Size < o.Size:
+			diff++
+			log.Printf(row, e.File, ManifestTruncated, fmt.Sprintf("%d/%d bytes, %d/%d packets", e.Size, o.Size, e.Count, o.Count))
+		case e.Size != o.Size || e.Sum != o.Sum || e.Count != o.Count:
+			diff++
+			log.Printf(row, e.File, ManifestModified, fmt.Sprintf("%s: %s, expected %s", digest, e.Sum, o.Sum))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fs := make([]string, 0, len(es))
+	for f := range es {
+		fs = append(fs, f)
+	}
+	sort.Strings(fs)
+	for _, f := range fs {
+		diff++
+		log.Printf(row, f, ManifestRemoved, fmt.Sprintf("%d bytes, %d packets", es[f].Size, es[f].Count))
+	}
+	log.Printf("%d differences found (%d files checked, %s)", diff, count, time.Since(now))
+	if diff > 0 {
+		return fmt.Errorf("archive does not match manifest")
+	}
+	return nil
+}
+
+func walkManifest(root string, d Decoder, digest string, fn func(*Entry) error) error {
+	return filepath.Walk(root, func(p string, i os.FileInfo, err error) error {
+		if err != nil || i.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		e, err := manifestEntry(p, d, digest)
+		if err != nil {
+			return err
+		}
+		e.File = filepath.ToSlash(rel)
+		return fn(e)
+	})
+}
+
+func manifestEntry(file string, d Decoder, digest string) (*Entry, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	h, err := NewDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		e     Entry
+		delta = GPS.Sub(UNIX)
+	)
+	rc, err := NewDecompressor(io.TeeReader(r, h))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	defer rc.Close()
+
+	s := Scan(rc)
+	for s.Scan() {
+		e.Count++
+		if d == nil {
+			continue
+		}
+		p, err := d.Decode(s.Bytes())
+		if err != nil {
+			continue
+		}
+		t := p.Timestamp().Add(delta)
+		if e.Starts.IsZero() || t.Before(e.Starts) {
+			e.Starts = t
+		}
+		if t.After(e.Ends) {
+			e.Ends = t
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	i, err := r.Stat()
+	if err != nil {
+		return nil, err
+	}
+	e.Size = i.Size()
+	e.Sum = fmt.Sprintf("%x", h.Sum(nil))
+	return &e, nil
+}
+
+func readManifest(file string) (string, map[string]*Entry, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	rs := csv.NewReader(r)
+	rs.FieldsPerRecord = 6
+
+	head, err := rs.Read()
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: invalid manifest: %s", file, err)
+	}
+	digest := head[len(head)-1]
+	if _, err := NewDigest(digest); err != nil {
+		return "", nil, err
+	}
+	es := make(map[string]*Entry)
+	for {
+		rec, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		e := Entry{
+			File: rec[0],
+			Sum:  rec[5],
+		}
+		if e.Size, err = strconv.ParseInt(rec[1], 10, 64); err != nil {
+			return "", nil, fmt.Errorf("%s: invalid size %s", e.File, rec[1])
+		}
+		if e.Count, err = strconv.Atoi(rec[2]); err != nil {
+			return "", nil, fmt.Errorf("%s: invalid packet count %s", e.File, rec[2])
+		}
+		e.Starts, _ = time.Parse(time.RFC3339Nano, rec[3])
+		e.Ends, _ = time.Parse(time.RFC3339Nano, rec[4])
+		es[e.File] = &e
+	}
+	return digest, es, nil
+}
+
+func formatManifestTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
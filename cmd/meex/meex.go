@@ -24,6 +24,23 @@ type Lesser interface {
 	Less(Packet) bool
 }
 
+type Realtimer interface {
+	Realtime() bool
+}
+
+// streamOf gives whether p is realtime data. ok is false when p is not part
+// of a stream or when its stream can not be determined.
+func streamOf(p interface{}) (realtime bool, ok bool) {
+	r, ok := p.(Realtimer)
+	if !ok {
+		return false, false
+	}
+	if c, ok := p.(interface{ Classified() bool }); ok && !c.Classified() {
+		return false, false
+	}
+	return r.Realtime(), true
+}
+
 type Packet interface {
 	Id() (int, int)
 	Sequence() int
@@ -55,6 +72,17 @@ type Decoder interface {
 	Decode([]byte) (Packet, error)
 }
 
+type Unframer interface {
+	Unframe(io.Reader) io.Reader
+}
+
+// Positioner is implemented by the readers given by Unframe. Position gives
+// the offset, in the framed stream, of the record being read or of the next
+// one when the current record has been read completely.
+type Positioner interface {
+	Position() int64
+}
+
 type Info struct {
 	Id       int       `json:"id"`
 	Sequence int       `json:"sequence"`
@@ -67,7 +95,7 @@ type Info struct {
 
 func (i *Info) String() string {
 	switch i.Type {
-	case "tm":
+	case "tm", "ccsds":
 		return fmt.Sprint(i.Id)
 	case "pp":
 		return fmt.Sprintf("%x", i.Id)
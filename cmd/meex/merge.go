@@ -2,8 +2,6 @@ package main
 
 import (
 	"io"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/midbel/cli"
@@ -29,26 +27,22 @@ func runJoin(cmd *cli.Command, args []string) error {
 	cmd.Flag.Var(&kind, "k", "packet type")
 	src := cmd.Flag.String("s", "", "source file")
 	dst := cmd.Flag.String("t", "", "dest file")
-	if err := cmd.Flag.Parse(args); err != nil {
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
-	source, err := os.Open(*src)
+	source, err := OpenSeeker(*src)
 	if err != nil {
 		return err
 	}
 	defer source.Close()
 
-	target, err := os.Open(*dst)
+	target, err := OpenSeeker(*dst)
 	if err != nil {
 		return err
 	}
 	defer target.Close()
 
-	tgt := cmd.Flag.Arg(0)
-	if err := os.MkdirAll(filepath.Dir(tgt), 0755); err != nil && !os.IsExist(err) {
-		return err
-	}
-	w, err := os.Create(tgt)
+	w, err := CreateFile(cmd.Flag.Arg(0))
 	if err != nil {
 		return err
 	}
@@ -58,23 +52,25 @@ func runJoin(cmd *cli.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	_, err = io.CopyBuffer(w, jr, make([]byte, MaxBufferSize))
-	return err
+	if _, err := io.CopyBuffer(w, jr, make([]byte, MaxBufferSize)); err != nil {
+		return err
+	}
+	return w.Close()
 }
 
 func runSort(cmd *cli.Command, args []string) error {
 	var kind Kind
 	cmd.Flag.Var(&kind, "k", "packet type")
-	if err := cmd.Flag.Parse(args); err != nil {
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
-	source, err := os.Open(cmd.Flag.Arg(0))
+	source, err := OpenSeeker(cmd.Flag.Arg(0))
 	if err != nil {
 		return err
 	}
 	defer source.Close()
 
-	target, err := os.Create(cmd.Flag.Arg(1))
+	target, err := CreateFile(cmd.Flag.Arg(1))
 	if err != nil {
 		return err
 	}
@@ -85,6 +81,8 @@ func runSort(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	_, err = io.CopyBuffer(NoDuplicate(target), s, make([]byte, MaxBufferSize))
-	return err
+	if _, err := io.CopyBuffer(NoDuplicate(target), s, make([]byte, MaxBufferSize)); err != nil {
+		return err
+	}
+	return target.Close()
 }
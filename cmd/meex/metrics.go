@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects the activity of the store receiver. It is exported in the
+// Prometheus text format. A nil *Metrics can be used and records nothing.
+type Metrics struct {
+	kind  string
+	stale time.Duration
+
+	mu          sync.Mutex
+	started     time.Time
+	received    uint64
+	bytesIn     uint64
+	bytesOut    uint64
+	rotated     uint64
+	frameErrors uint64
+	writeErrors uint64
+	decodeErrs  uint64
+	connections uint64
+	active      int64
+	file        string
+	last        time.Time
+	keys        map[string]*keyMetrics
+	sources     map[string]*sourceMetrics
+	forwards    map[string]*forwardMetrics
+}
+
+type sourceMetrics struct {
+	datagrams uint64
+	oversized uint64
+}
+
+type forwardMetrics struct {
+	sent    uint64
+	dropped uint64
+}
+
+type keyMetrics struct {
+	count   uint64
+	size    uint64
+	missing uint64
+	last    Packet
+	when    time.Time
+	latency time.Duration
+}
+
+func NewMetrics(k Kind, stale time.Duration) *Metrics {
+	return &Metrics{
+		kind:     k.Name,
+		stale:    stale,
+		started:  time.Now(),
+		keys:     make(map[string]*keyMetrics),
+		sources:  make(map[string]*sourceMetrics),
+		forwards: make(map[string]*forwardMetrics),
+	}
+}
+
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	})
+	mux.HandleFunc("/health", m.health)
+	return mux
+}
+
+func (m *Metrics) Received(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesIn += uint64(n)
+}
+
+func (m *Metrics) FrameError() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.frameErrors++
+}
+
+func (m *Metrics) WriteError() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeErrors++
+}
+
+// Written records a framed packet of size bytes written in the current file.
+// The packet decoded by the receiver updates the counters of its key.
+func (m *Metrics) Written(size int, p Packet, err error) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received++
+	m.bytesOut += uint64(size)
+	m.last = now
+	if err != nil {
+		if err != ErrSkip {
+			m.decodeErrs++
+		}
+		return
+	}
+	if p == nil {
+		return
+	}
+	key := defaultPacketKey(p)
+	k, ok := m.keys[key]
+	if !ok {
+		k = &keyMetrics{}
+		m.keys[key] = k
+	}
+	k.count++
+	k.size += uint64(size)
+	if g := p.Diff(k.last); g != nil {
+		k.missing += uint64(g.Missing())
+	}
+	k.last, k.when = p, now
+	k.latency = now.Sub(p.Timestamp().Add(GPS.Sub(UNIX)))
+}
+
+// Datagram records a datagram received from source. Oversized datagrams are
+// dropped by the receiver.
+func (m *Metrics) Datagram(source string, oversized bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sources[source]
+	if !ok {
+		s = &sourceMetrics{}
+		m.sources[source] = s
+	}
+	s.datagrams++
+	if oversized {
+		s.oversized++
+	}
+}
+
+func (m *Metrics) Forwarded(dest string, dropped bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.forwards[dest]
+	if !ok {
+		f = &forwardMetrics{}
+		m.forwards[dest] = f
+	}
+	if dropped {
+		f.dropped++
+	} else {
+		f.sent++
+	}
+}
+
+func (m *Metrics) Rotated(file string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file != "" {
+		m.rotated++
+	}
+	m.file = file
+}
+
+func (m *Metrics) Connect() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+	m.active++
+}
+
+func (m *Metrics) Disconnect() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		c    bytes.Buffer
+		kind = "kind=" + quoteLabel(m.kind)
+	)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&c, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	sample := func(name, labels string, v interface{}) {
+		fmt.Fprintf(&c, "%s{%s} %v\n", name, labels, v)
+	}
+	metric("meex_store_up_seconds", "gauge", "Time since the receiver started.")
+	sample("meex_store_up_seconds", kind, time.Since(m.started).Seconds())
+	metric("meex_store_received_bytes_total", "counter", "Bytes read from the network.")
+	sample("meex_store_received_bytes_total", kind, m.bytesIn)
+	metric("meex_store_written_bytes_total", "counter", "Bytes written in RT files.")
+	sample("meex_store_written_bytes_total", kind, m.bytesOut)
+	metric("meex_store_files_rotated_total", "counter", "RT files rotated.")
+	sample("meex_store_files_rotated_total", kind, m.rotated)
+	metric("meex_store_errors_total", "counter", "Errors by stage (frame, write, decode).")
+	sample("meex_store_errors_total", kind+`,stage="frame"`, m.frameErrors)
+	sample("meex_store_errors_total", kind+`,stage="write"`, m.writeErrors)
+	sample("meex_store_errors_total", kind+`,stage="decode"`, m.decodeErrs)
+	metric("meex_store_connections_total", "counter", "TCP connections accepted.")
+	sample("meex_store_connections_total", kind, m.connections)
+	metric("meex_store_connections", "gauge", "TCP connections currently opened.")
+	sample("meex_store_connections", kind, m.active)
+	metric("meex_store_file_info", "gauge", "RT file currently written.")
+	sample("meex_store_file_info", kind+`,file=`+quoteLabel(m.file), 1)
+	if !m.last.IsZero() {
+		metric("meex_store_last_packet_timestamp_seconds", "gauge", "Reception time of the last packet.")
+		sample("meex_store_last_packet_timestamp_seconds", kind, unixSeconds(m.last))
+	}
+
+	ss := make([]string, 0, len(m.sources))
+	for s := range m.sources {
+		ss = append(ss, s)
+	}
+	sort.Strings(ss)
+	if len(ss) > 0 {
+		metric("meex_store_datagrams_total", "counter", "Datagrams received by source.")
+		for _, s := range ss {
+			sample("meex_store_datagrams_total", kind+",source="+quoteLabel(s), m.sources[s].datagrams)
+		}
+		metric("meex_store_datagrams_oversized_total", "counter", "Datagrams dropped because larger than the maximum size.")
+		for _, s := range ss {
+			sample("meex_store_datagrams_oversized_total", kind+",source="+quoteLabel(s), m.sources[s].oversized)
+		}
+	}
+
+	fs := make([]string, 0, len(m.forwards))
+	for f := range m.forwards {
+		fs = append(fs, f)
+	}
+	sort.Strings(fs)
+	if len(fs) > 0 {
+		metric("meex_store_forwarded_total", "counter", "Packets sent to a forward destination.")
+		for _, f := range fs {
+			sample("meex_store_forwarded_total", kind+",destination="+quoteLabel(f), m.forwards[f].sent)
+		}
+		metric("meex_store_forward_dropped_total", "counter", "Packets dropped for a forward destination.")
+		for _, f := range fs {
+			sample("meex_store_forward_dropped_total", kind+",destination="+quoteLabel(f), m.forwards[f].dropped)
+		}
+	}
+
+	ks := make([]string, 0, len(m.keys))
+	for k := range m.keys {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	perKey := []struct {
+		name, typ, help string
+		value           func(*keyMetrics) interface{}
+	}{
+		{"meex_store_packets_total", "counter", "Packets received.", func(k *keyMetrics) interface{} { return k.count }},
+		{"meex_store_packets_bytes_total", "counter", "Bytes of packets received.", func(k *keyMetrics) interface{} { return k.size }},
+		{"meex_store_packets_missing_total", "counter", "Packets missing according to sequence counters.", func(k *keyMetrics) interface{} { return k.missing }},
+		{"meex_store_packet_timestamp_seconds", "gauge", "Reception time of the last packet.", func(k *keyMetrics) interface{} { return unixSeconds(k.when) }},
+		{"meex_store_latency_seconds", "gauge", "Delay between acquisition and reception of the last packet.", func(k *keyMetrics) interface{} { return k.latency.Seconds() }},
+	}
+	for _, p := range perKey {
+		if len(ks) == 0 {
+			break
+		}
+		metric(p.name, p.typ, p.help)
+		for _, k := range ks {
+			sample(p.name, kind+",key="+quoteLabel(k), p.value(m.keys[k]))
+		}
+	}
+	return c.WriteTo(w)
+}
+
+func (m *Metrics) health(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	s := struct {
+		Status string    `json:"status"`
+		Kind   string    `json:"kind"`
+		File   string    `json:"file"`
+		Last   time.Time `json:"last,omitempty"`
+		Count  uint64    `json:"count"`
+	}{
+		Status: "ok",
+		Kind:   m.kind,
+		File:   m.file,
+		Last:   m.last,
+		Count:  m.received,
+	}
+	code := http.StatusOK
+	if m.stale > 0 && time.Since(maxTime(m.last, m.started)) > m.stale {
+		s.Status, code = "stale", http.StatusServiceUnavailable
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
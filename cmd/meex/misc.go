@@ -4,12 +4,13 @@ import (
 	"bufio"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"hash"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/midbel/cli"
@@ -25,22 +26,28 @@ var sumCommand = &cli.Command{
 }
 
 var scanCommand = &cli.Command{
-	Usage: "scan <file...>",
+	Usage: "scan [-strict] <file...>",
 	Short: "fast scanning of RT file(s)",
 	Run:   runScan,
 }
 
 var indexCommand = &cli.Command{
-	Usage: "index [-q quiet] [-k type] <file...>",
+	Usage: "index [-q quiet] [-k type] [-w filter] [-strict] <file...>",
 	Short: "create an index of packets found in RT files",
 	Run:   runIndex,
 }
 
 func runIndex(cmd *cli.Command, args []string) error {
-	var kind Kind
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
 	quiet := cmd.Flag.Bool("q", false, "quiet")
-	if err := cmd.Flag.Parse(args); err != nil {
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
 	delta := GPS.Sub(UNIX)
@@ -51,7 +58,7 @@ func runIndex(cmd *cli.Command, args []string) error {
 		prev  time.Time
 	)
 	now := time.Now()
-	for p := range Walk(cmd.Flag.Args(), kind.Decod) {
+	for p := range WalkTraced(cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle) {
 		count++
 		t := p.Timestamp().Add(delta)
 		if prev.IsZero() || (t.Minute()%5 == 0 && t.Sub(prev) >= Five) {
@@ -67,36 +74,36 @@ func runIndex(cmd *cli.Command, args []string) error {
 	}
 	elapsed := time.Since(now)
 	log.Printf("%d packets (%dMB) found in %s (%.2fMB/s)", count, data>>20, elapsed, float64(data>>20)/elapsed.Seconds())
-	return nil
+	errs.Summary()
+	return errs.Err()
 }
 
 func runSum(cmd *cli.Command, args []string) error {
 	digest := cmd.Flag.String("d", "", "digest")
-	if err := cmd.Flag.Parse(args); err != nil {
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
 	var group errgroup.Group
 	for _, a := range cmd.Flag.Args() {
 		file := a
 		group.Go(func() error {
-			r, err := os.Open(file)
+			r, err := OpenFile(file)
 			if err != nil {
 				return err
 			}
 			defer r.Close()
 
-			var d hash.Hash
 			switch *digest {
-			default:
+			case "", "rfc1071":
 				log.Printf("%04x %s", sumRFC1071(r), file)
 				return nil
 			case "fletcher":
 				log.Printf("%08x %s", sumFletcher32(r), file)
 				return nil
-			case "md5":
-				d = md5.New()
-			case "sha":
-				d = sha1.New()
+			}
+			d, err := NewDigest(*digest)
+			if err != nil {
+				return err
 			}
 			if _, err := io.Copy(d, r); err != nil {
 				return err
@@ -108,33 +115,48 @@ func runSum(cmd *cli.Command, args []string) error {
 	return group.Wait()
 }
 
+func NewDigest(n string) (hash.Hash, error) {
+	switch strings.ToLower(n) {
+	case "md5":
+		return md5.New(), nil
+	case "sha", "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "xxh", "xxh64":
+		return xxh.New64(0), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest %s", n)
+	}
+}
+
 func runScan(cmd *cli.Command, args []string) error {
-	if err := cmd.Flag.Parse(args); err != nil {
+	var errs Errors
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
 	now := time.Now()
 
 	var size, count uint64
 	for _, a := range cmd.Flag.Args() {
-		filepath.Walk(a, func(p string, i os.FileInfo, err error) error {
-			if err != nil || i.IsDir() {
-				return err
-			}
-			sc, err := ScanFile(p)
-			if err != nil {
-				return err
-			}
+		err := WalkSources(a, func(_ string, r io.Reader) error {
+			sc := Scan(r)
 			for sc.Scan() {
 				count++
 				size += uint64(len(sc.Bytes()))
 			}
 			return sc.Err()
 		})
+		if err != nil && errs.Handle(err) != nil {
+			break
+		}
 	}
 	elapsed := time.Since(now)
 	ratio := float64(size>>20) / elapsed.Seconds()
 	log.Printf("%d packets scanned (%dMB) time: %s (%.2f MB/s)", count, size>>20, elapsed, ratio)
-	return nil
+	errs.Summary()
+	return errs.Err()
 }
 
 func sumFletcher32(r io.Reader) uint32 {
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var paramsCommand = &cli.Command{
+	Usage: "params [-k type] [-d dictionary] [-w filter] [-f format] [-p parameters] [-s starts] [-e ends] [-g gps-time] [-strict] <file...>",
+	Short: "decode parameters of TM packets described in a packet dictionary",
+	Run:   runParams,
+}
+
+const (
+	ParamUint   = "uint"
+	ParamInt    = "int"
+	ParamFloat  = "float"
+	ParamBool   = "bool"
+	ParamBytes  = "bytes"
+	ParamString = "string"
+)
+
+// Dictionary describes the parameters carried by TM packets. It is loaded from
+// a JSON file such as:
+//
+//	{
+//	  "packets": [{
+//	    "name": "hk", "apid": 1234, "source": 42, "type": "payload hk",
+//	    "parameters": [{
+//	      "name": "temperature", "offset": 16, "bit": 0, "size": 12, "type": "uint",
+//	      "unit": "degC", "calibration": {"polynomial": [-40, 0.05]}
+//	    }]
+//	  }]
+//	}
+//
+// Offsets are given in bytes from the first byte of the CCSDS primary header
+// and bits are counted from the most significant bit of that byte. source and
+// type (ESA packet type) are optional.
+type Dictionary struct {
+	Packets []*Definition `json:"packets"`
+}
+
+type Definition struct {
+	Name       string       `json:"name"`
+	Apid       int          `json:"apid"`
+	Source     *uint32      `json:"source"`
+	Type       string       `json:"type"`
+	Parameters []*Parameter `json:"parameters"`
+}
+
+type Parameter struct {
+	Name        string       `json:"name"`
+	Offset      int          `json:"offset"`
+	Bit         int          `json:"bit"`
+	Size        int          `json:"size"`
+	Type        string       `json:"type"`
+	Endian      string       `json:"endian"`
+	Unit        string       `json:"unit"`
+	Calibration *Calibration `json:"calibration"`
+}
+
+type Calibration struct {
+	Polynomial []float64         `json:"polynomial"`
+	Points     [][2]float64      `json:"points"`
+	Enum       map[string]string `json:"enum"`
+}
+
+type Value struct {
+	Name  string      `json:"name"`
+	Raw   interface{} `json:"raw"`
+	Value interface{} `json:"value"`
+	Unit  string      `json:"unit,omitempty"`
+}
+
+func LoadDictionary(file string) (*Dictionary, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var d Dictionary
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	for _, p := range d.Packets {
+		if err := p.check(); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	return &d, nil
+}
+
+func (d *Dictionary) Lookup(p Packet) (*Definition, []byte) {
+	var (
+		c   *CCSDSHeader
+		e   *ESAHeader
+		bs  []byte
+		off int
+	)
+	switch p := p.(type) {
+	case *TMPacket:
+		c, e, off = p.CCSDS, p.ESA, PTHHeaderLen
+	case *CCSDSPacket:
+		c, e, off = p.CCSDS, p.ESA, 4
+	default:
+		return nil, nil
+	}
+	bs = p.Bytes()[off:]
+	for _, f := range d.Packets {
+		if f.Apid != c.Apid() {
+			continue
+		}
+		if f.Source != nil && (e == nil || *f.Source != e.Source) {
+			continue
+		}
+		if f.Type != "" && (e == nil || !strings.EqualFold(f.Type, e.PacketType().String())) {
+			continue
+		}
+		return f, bs
+	}
+	return nil, nil
+}
+
+func (f *Definition) check() error {
+	if f.Name == "" {
+		f.Name = strconv.Itoa(f.Apid)
+	}
+	for _, p := range f.Parameters {
+		if p.Type == "" {
+			p.Type = ParamUint
+		}
+		if p.Name == "" {
+			return fmt.Errorf("%s: parameter without name", f.Name)
+		}
+		if p.Offset < 0 || p.Bit < 0 || p.Bit > 7 {
+			return fmt.Errorf("%s.%s: invalid position", f.Name, p.Name)
+		}
+		switch p.Type {
+		case ParamUint, ParamInt, ParamBool:
+			if p.Size <= 0 || p.Size > 64 {
+				return fmt.Errorf("%s.%s: invalid size %d", f.Name, p.Name, p.Size)
+			}
+		case ParamFloat:
+			if p.Size != 32 && p.Size != 64 {
+				return fmt.Errorf("%s.%s: float must be 32 or 64 bits", f.Name, p.Name)
+			}
+		case ParamBytes, ParamString:
+			if p.Size <= 0 || p.Size%8 != 0 || p.Bit != 0 {
+				return fmt.Errorf("%s.%s: %s must be byte aligned", f.Name, p.Name, p.Type)
+			}
+		default:
+			return fmt.Errorf("%s.%s: unsupported type %s", f.Name, p.Name, p.Type)
+		}
+		switch strings.ToLower(p.Endian) {
+		case "", "big":
+		case "little":
+			if p.Size%8 != 0 || p.Bit != 0 {
+				return fmt.Errorf("%s.%s: little endian values must be byte aligned", f.Name, p.Name)
+			}
+		default:
+			return fmt.Errorf("%s.%s: unsupported endianness %s", f.Name, p.Name, p.Endian)
+		}
+	}
+	return nil
+}
+
+func (f *Definition) Decode(bs []byte, names map[string]bool) ([]Value, error) {
+	vs := make([]Value, 0, len(f.Parameters))
+	for _, p := range f.Parameters {
+		if len(names) > 0 && !names[p.Name] {
+			continue
+		}
+		v, err := p.Decode(bs)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", f.Name, p.Name, err)
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+func (p *Parameter) Decode(bs []byte) (Value, error) {
+	v := Value{
+		Name: p.Name,
+		Unit: p.Unit,
+	}
+	pos := p.Offset*8 + p.Bit
+	if pos+p.Size > len(bs)*8 {
+		return v, ErrShortBuffer
+	}
+	switch p.Type {
+	case ParamBytes, ParamString:
+		raw := bs[p.Offset : p.Offset+p.Size/8]
+		if p.Type == ParamString {
+			v.Raw = strings.TrimRight(string(raw), "\x00 ")
+		} else {
+			v.Raw = hex.EncodeToString(raw)
+		}
+		v.Value = v.Raw
+		return v, nil
+	}
+	u := readBits(bs, pos, p.Size)
+	if strings.ToLower(p.Endian) == "little" {
+		u = swapBytes(u, p.Size/8)
+	}
+	var f float64
+	switch p.Type {
+	case ParamUint:
+		v.Raw, f = u, float64(u)
+	case ParamInt:
+		i := int64(u<<uint(64-p.Size)) >> uint(64-p.Size)
+		v.Raw, f = i, float64(i)
+	case ParamFloat:
+		if p.Size == 32 {
+			f = float64(math.Float32frombits(uint32(u)))
+		} else {
+			f = math.Float64frombits(u)
+		}
+		v.Raw = f
+	case ParamBool:
+		v.Raw, f = u != 0, float64(u)
+	}
+	v.Value = p.Calibration.Apply(v.Raw, f)
+	return v, nil
+}
+
+func (c *Calibration) Apply(raw interface{}, f float64) interface{} {
+	switch {
+	case c == nil:
+		return raw
+	case len(c.Enum) > 0:
+		if s, ok := c.Enum[strconv.FormatFloat(f, 'f', -1, 64)]; ok {
+			return s
+		}
+		return raw
+	case len(c.Points) > 0:
+		return interpolate(c.Points, f)
+	case len(c.Polynomial) > 0:
+		var v float64
+		for i := len(c.Polynomial) - 1; i >= 0; i-- {
+			v = v*f + c.Polynomial[i]
+		}
+		return v
+	default:
+		return raw
+	}
+}
+
+func interpolate(ps [][2]float64, f float64) float64 {
+	if len(ps) == 1 {
+		return ps[0][1]
+	}
+	i := sort.Search(len(ps), func(i int) bool { return ps[i][0] >= f })
+	switch {
+	case i == 0:
+		i = 1
+	case i == len(ps):
+		i = len(ps) - 1
+	}
+	x0, y0, x1, y1 := ps[i-1][0], ps[i-1][1], ps[i][0], ps[i][1]
+	if x1 == x0 {
+		return y0
+	}
+	return y0 + (f-x0)*(y1-y0)/(x1-x0)
+}
+
+func readBits(bs []byte, pos, size int) uint64 {
+	var u uint64
+	for i := pos; i < pos+size; i++ {
+		u = u<<1 | uint64(bs[i/8]>>uint(7-i%8)&0x1)
+	}
+	return u
+}
+
+func swapBytes(u uint64, n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v = v<<8 | u&0xFF
+		u >>= 8
+	}
+	return v
+}
+
+func runParams(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	dict := cmd.Flag.String("d", "", "packet dictionary")
+	format := cmd.Flag.String("f", "csv", "output format (csv, json)")
+	params := cmd.Flag.String("p", "", "comma separated list of parameters")
+	starts := cmd.Flag.String("s", "", "start time")
+	ends := cmd.Flag.String("e", "", "end time")
+	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		kind.Set("tm")
+	}
+	d, err := LoadDictionary(*dict)
+	if err != nil {
+		return err
+	}
+	var from, to time.Time
+	if *starts != "" {
+		if from, err = time.Parse(time.RFC3339, *starts); err != nil {
+			return err
+		}
+	}
+	if *ends != "" {
+		if to, err = time.Parse(time.RFC3339, *ends); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, n := range strings.Split(*params, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names[n] = true
+		}
+	}
+	var delta time.Duration
+	if *toGPS {
+		delta = -GPS.Sub(UNIX)
+	}
+
+	var write func(Packet, *Definition, []Value) error
+	switch strings.ToLower(*format) {
+	case "csv", "":
+		ws := csv.NewWriter(os.Stdout)
+		defer ws.Flush()
+		ws.Write([]string{"time", "apid", "sequence", "packet", "parameter", "raw", "value", "unit"})
+		write = func(p Packet, f *Definition, vs []Value) error {
+			t := p.Timestamp().Add(delta).Format(time.RFC3339Nano)
+			for _, v := range vs {
+				rec := []string{
+					t,
+					strconv.Itoa(f.Apid),
+					strconv.Itoa(p.Sequence()),
+					f.Name,
+					v.Name,
+					fmt.Sprint(v.Raw),
+					fmt.Sprint(v.Value),
+					v.Unit,
+				}
+				if err := ws.Write(rec); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case "json", "ndjson":
+		e := json.NewEncoder(os.Stdout)
+		write = func(p Packet, f *Definition, vs []Value) error {
+			r := struct {
+				When       time.Time `json:"time"`
+				Apid       int       `json:"apid"`
+				Sequence   int       `json:"sequence"`
+				Packet     string    `json:"packet"`
+				Parameters []Value   `json:"parameters"`
+			}{
+				When:       p.Timestamp().Add(delta),
+				Apid:       f.Apid,
+				Sequence:   p.Sequence(),
+				Packet:     f.Name,
+				Parameters: vs,
+			}
+			return e.Encode(r)
+		}
+	default:
+		return fmt.Errorf("unsupported output format %s", *format)
+	}
+
+	for p := range WalkTraced(cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle) {
+		t := p.Timestamp()
+		if (!from.IsZero() && t.Before(from)) || (!to.IsZero() && !t.Before(to)) {
+			continue
+		}
+		f, bs := d.Lookup(p.Packet)
+		if f == nil {
+			continue
+		}
+		vs, err := f.Decode(bs, names)
+		if err != nil {
+			if err := errs.Handle(&PacketError{Provenance: p.Provenance, Err: err}); err != nil {
+				break
+			}
+			continue
+		}
+		if len(vs) == 0 {
+			continue
+		}
+		if err := write(p.Packet, f, vs); err != nil {
+			return err
+		}
+	}
+	errs.Summary()
+	return errs.Err()
+}
@@ -25,37 +25,46 @@ func NewPrinter(f string) (*Printer, error) {
 	}
 	p := Printer{
 		line:    linewriter.NewWriter(1024, options...),
-		history: make(map[int]Packet),
+		history: make(map[string]Packet),
 	}
 	return &p, nil
 }
 
 type Printer struct {
 	line    *linewriter.Writer
-	history map[int]Packet
+	history map[string]Packet
 }
 
 func (pt *Printer) Print(p Packet, delta time.Duration) error {
-	id, _ := p.Id()
-	switch p := p.(type) {
-	default:
-	case *VMUPacket:
-		printVMUPacket(pt.line, p, p.Diff(pt.history[id]), delta)
-	case *TMPacket:
-		printTMPacket(pt.line, p, p.Diff(pt.history[id]), delta)
-	case *PDPacket:
-		printPDPacket(pt.line, p, delta)
-	}
+	return pt.print(p, nil, delta)
+}
+
+func (pt *Printer) PrintTraced(p *TracedPacket, delta time.Duration) error {
+	return pt.print(p.Packet, &p.Provenance, delta)
+}
+
+func (pt *Printer) print(p Packet, v *Provenance, delta time.Duration) error {
+	id := defaultPacketKey(p)
+	ok := printPacket(pt.line, p, p.Diff(pt.history[id]), delta)
 	pt.history[id] = p
-	return nil
+	if !ok {
+		return nil
+	}
+	if v != nil {
+		pt.line.AppendUint(uint64(v.Index), 4, linewriter.AlignRight)
+		pt.line.AppendUint(uint64(v.Offset), 10, linewriter.AlignRight)
+		pt.line.AppendString(v.File, len(v.File), linewriter.AlignLeft)
+	}
+	_, err := io.Copy(os.Stdout, pt.line)
+	return err
 }
 
-func printVMUPacket(line *linewriter.Writer, p *VMUPacket, g *Gap, delta time.Duration) {
+func printVMUPacket(line *linewriter.Writer, p *VMUPacket, g *Gap, delta time.Duration) bool {
 	a := p.HRH.Acquisition.Add(delta)
 
 	hr, err := p.Data()
 	if err != nil {
-		return
+		return false
 	}
 	var v *VMUCommonHeader
 	switch hr := hr.(type) {
@@ -64,14 +73,9 @@ func printVMUPacket(line *linewriter.Writer, p *VMUPacket, g *Gap, delta time.Du
 	case *Table:
 		v = hr.VMUCommonHeader
 	default:
-		return
-	}
-	var rt string
-	if v.Origin == p.VMU.Origin {
-		rt = "realtime"
-	} else {
-		rt = "playback"
+		return false
 	}
+	rt := streamLabel(v)
 	q := v.Acquisition()
 	var diff int
 	if g != nil {
@@ -98,10 +102,10 @@ func printVMUPacket(line *linewriter.Writer, p *VMUPacket, g *Gap, delta time.Du
 	line.AppendUint(xxh.Sum64(p.Payload, 0), 16, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
 	line.AppendDuration(p.HRH.Reception.Sub(p.HRH.Acquisition), 9, linewriter.AlignLeft|linewriter.Millisecond)
 
-	io.Copy(os.Stdout, line)
+	return true
 }
 
-func printTMPacket(line *linewriter.Writer, p *TMPacket, g *Gap, delta time.Duration) {
+func printTMPacket(line *linewriter.Writer, p *TMPacket, g *Gap, delta time.Duration) bool {
 	a := p.Timestamp().Add(delta)
 	r := p.Reception().Add(delta)
 
@@ -121,10 +125,10 @@ func printTMPacket(line *linewriter.Writer, p *TMPacket, g *Gap, delta time.Dura
 	line.AppendUint(xxh.Sum64(p.Bytes(), 0), 8, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
 	line.AppendDuration(p.Reception().Sub(p.Timestamp()), 8, linewriter.AlignLeft|linewriter.Millisecond)
 
-	io.Copy(os.Stdout, line)
+	return true
 }
 
-func printPDPacket(line *linewriter.Writer, p *PDPacket, delta time.Duration) {
+func printPDPacket(line *linewriter.Writer, p *PDPacket, delta time.Duration) bool {
 	a := p.Timestamp().Add(delta)
 	ds := p.Payload[len(p.Payload)-int(p.UMI.Len):]
 	if len(ds) > 16 {
@@ -142,5 +146,5 @@ func printPDPacket(line *linewriter.Writer, p *PDPacket, delta time.Duration) {
 	line.AppendString(typ, 10, linewriter.AlignRight)
 	line.AppendBytes(ds, 8, linewriter.AlignLeft|linewriter.Hex)
 
-	io.Copy(os.Stdout, line)
+	return true
 }
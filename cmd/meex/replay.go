@@ -11,5 +11,5 @@ var replayCommand = &cli.Command{
 }
 
 func runReplay(cmd *cli.Command, args []string) error {
-	return cmd.Flag.Parse(args)
+	return parseArgs(cmd, args)
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/midbel/cli"
@@ -11,41 +15,54 @@ import (
 const TimeFormat = "2006-01-02 15:04:05.000"
 
 var countCommand = &cli.Command{
-	Usage: "count [-k type] [-g gps-time] <file...>",
+	Usage: "count [-k type] [-m stream] [-w filter] [-g gps-time] [-strict] <file...>",
 	Short: "count packets available into RT file(s)",
 	Run:   runCount,
 }
 
 var listCommand = &cli.Command{
-	Usage: "list [-e with-invalid] [-f format] [-k type] [-g gps-time] [-i pid] <file...>",
+	Usage: "list [-e with-invalid] [-f format] [-k type] [-m stream] [-w filter] [-g gps-time] [-i pid] [-s source] [-strict] [-follow] [-latency duration] [-alert target] <file...>",
 	Alias: []string{"ls"},
 	Short: "list packets present into RT file(s)",
 	Run:   runList,
 }
 
 var diffCommand = &cli.Command{
-	Usage: "diff [-g gps-time] [-k type] [-d duration] <file...>",
+	Usage: "diff [-g gps-time] [-k type] [-w filter] [-d duration] [-s source] [-strict] [-follow] [-latency duration] [-alert target] <file...>",
 	Alias: []string{"show-gaps"},
 	Short: "report missing packets in RT file(s)",
 	Run:   runDiff,
 }
 
 var errCommand = &cli.Command{
-	Usage: "verify [-k type] <file...>",
+	Usage: "verify [-k type] [-w filter] [-s source] [-q quarantine] [-strict] [-follow] [-latency duration] [-alert target] <file...>",
 	Alias: []string{"check"},
 	Short: "report error in packets found in RT file(s)",
 	Run:   runError,
 }
 
 func runList(cmd *cli.Command, args []string) error {
-	var kind Kind
+	var (
+		kind   Kind
+		stream Stream
+		filter Filter
+		errs   Errors
+		follow Follow
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&stream, "m", "realtime or playback stream")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
 	mem := cmd.Flag.Bool("memprofile", false, "profile memory usage")
 	format := cmd.Flag.String("f", "", "format")
 	id := cmd.Flag.Int("i", 0, "")
 	toGPS := cmd.Flag.Bool("g", false, "gps time")
 	erronly := cmd.Flag.Bool("e", false, "include invalid packets")
-	if err := cmd.Flag.Parse(args); err != nil {
+	source := cmd.Flag.Bool("s", false, "print source file and offset of packets")
+	cmd.Flag.BoolVar(&follow.Enabled, "follow", false, "follow files written by store in a directory")
+	cmd.Flag.DurationVar(&follow.Latency, "latency", 0, "alert when packets are received later than duration")
+	cmd.Flag.Var(&follow.Alerts, "alert", "alert target (log, json or webhook url)")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
 
@@ -61,7 +78,10 @@ func runList(cmd *cli.Command, args []string) error {
 	if *toGPS {
 		delta = -GPS.Sub(UNIX)
 	}
-	queue := Walk(cmd.Flag.Args(), DecodeById(*id, kind.Decod))
+	ctx, cancel := follow.Context()
+	defer cancel()
+
+	queue := follow.Walk(ctx, cmd.Flag.Args(), DecodeByFilter(&filter, DecodeByStream(stream, DecodeById(*id, kind.Decod))), errs.Handle)
 	var size, total uint64
 	n := time.Now()
 	for p := range queue {
@@ -70,21 +90,38 @@ func runList(cmd *cli.Command, args []string) error {
 		}
 		total++
 		size += uint64(p.Len())
-		if err := pt.Print(p, delta); err != nil {
+		if *source {
+			err = pt.PrintTraced(p, delta)
+		} else {
+			err = pt.Print(p.Packet, delta)
+		}
+		if err != nil {
 			return err
 		}
 	}
 	log.Printf("%d packets found %s (%dMB)", total, time.Since(n), size>>20)
-	return nil
+	errs.Summary()
+	return errs.Err()
 }
 
 func runDiff(cmd *cli.Command, args []string) error {
-	var kind Kind
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+		follow Follow
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
 	mem := cmd.Flag.Bool("memprofile", false, "profile memory usage")
-	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	toGPS := cmd.Flag.Bool("g", false, "to gps time")
 	duration := cmd.Flag.Duration("d", 0, "duration")
-	if err := cmd.Flag.Parse(args); err != nil {
+	source := cmd.Flag.Bool("s", false, "print files bracketing gaps")
+	cmd.Flag.BoolVar(&follow.Enabled, "follow", false, "follow files written by store in a directory")
+	cmd.Flag.DurationVar(&follow.Latency, "latency", 0, "alert when packets are received later than duration")
+	cmd.Flag.Var(&follow.Alerts, "alert", "alert target (log, json or webhook url)")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
 
@@ -105,7 +142,10 @@ func runDiff(cmd *cli.Command, args []string) error {
 		elapsed time.Duration
 	)
 
-	for g := range Gaps(cmd.Flag.Args(), kind.Decod) {
+	ctx, cancel := follow.Context()
+	defer cancel()
+
+	for g := range GapsOf(ctx, follow.Walk(ctx, cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle)) {
 		count++
 		missing += uint64(g.Missing())
 		elapsed += g.Duration()
@@ -114,55 +154,196 @@ func runDiff(cmd *cli.Command, args []string) error {
 			p := g.Starts.Add(delta).Format(TimeFormat)
 			c := g.Ends.Add(delta).Format(TimeFormat)
 
-			log.Printf(row, g.Key, p, c, g.Last, g.First, g.Missing(), g.Duration())
+			if *source {
+				log.Printf(row+" | %s | %s", g.Key, p, c, g.Last, g.First, g.Missing(), g.Duration(), g.From, g.To)
+			} else {
+				log.Printf(row, g.Key, p, c, g.Last, g.First, g.Missing(), g.Duration())
+			}
+			follow.Alerts.Send(Alert{
+				Type:    AlertGap,
+				When:    g.Starts,
+				Key:     g.Key,
+				Message: fmt.Sprintf("%d packets missing (%d -> %d, %s)", g.Missing(), g.Last, g.First, g.Duration()),
+				Source:  g.To.String(),
+			})
 		}
 	}
 	log.Printf("%d gaps found (%d missing packets - %s)", count, missing, elapsed)
-	return nil
+	errs.Summary()
+	return errs.Err()
 }
 
 func runError(cmd *cli.Command, args []string) error {
-	var kind Kind
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+		follow Follow
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
-	if err := cmd.Flag.Parse(args); err != nil {
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	source := cmd.Flag.Bool("s", false, "print file and offset of packets with error")
+	quarantine := cmd.Flag.String("q", "", "write packets with error to file")
+	cmd.Flag.BoolVar(&follow.Enabled, "follow", false, "follow files written by store in a directory")
+	cmd.Flag.DurationVar(&follow.Latency, "latency", 0, "alert when packets are received later than duration")
+	cmd.Flag.Var(&follow.Alerts, "alert", "alert target (log, json or webhook url)")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
+	const (
+		row  = "%20s | %04x | %-24s | %s"
+		crow = "%-10s | %-5s | %02x | %8d | %s | %s"
+	)
+
+	var w io.WriteCloser
+	if *quarantine != "" {
+		wc, err := CreateFile(*quarantine)
+		if err != nil {
+			return err
+		}
+		w = wc
+	}
 
 	var err, total uint64
 	cs := make(map[uint64]uint64)
+	rs := make(map[errorKey]*errorRange)
+
+	ctx, cancel := follow.Context()
+	defer cancel()
 
 	n := time.Now()
-	for p := range Walk(cmd.Flag.Args(), kind.Decod) {
+	for p := range follow.Walk(ctx, cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle) {
 		total++
 		if !p.Error() {
 			continue
 		}
 		err++
 
-		switch p := p.(type) {
+		var (
+			code uint64
+			flag = "-"
+		)
+		switch p := p.Packet.(type) {
 		default:
 		case *VMUPacket:
-			cs[uint64(p.HRH.Error)]++
+			code = uint64(p.HRH.Error)
+			cs[code]++
+
+			es := p.Errors()
+			for _, e := range es {
+				k := errorKey{Category: e, Channel: p.VMU.Channel, Origin: p.VMU.Origin}
+				r, ok := rs[k]
+				if !ok {
+					r = &errorRange{Starts: p.Timestamp()}
+					rs[k] = r
+				}
+				r.Update(p.Timestamp())
+			}
+			flag = strings.Join(es, "|")
 		case *PDPacket:
-			cs[uint64(p.UMI.Orbit)]++
+			code = uint64(p.UMI.Orbit)
+			cs[code]++
+		}
+		if *source {
+			log.Printf(row, defaultPacketKey(p.Packet), code, flag, p.Provenance)
+		}
+		follow.Alerts.Send(Alert{
+			Type:    AlertError,
+			When:    p.Timestamp(),
+			Key:     defaultPacketKey(p.Packet),
+			Message: fmt.Sprintf("invalid packet (%04x: %s)", code, flag),
+			Source:  p.Provenance.String(),
+		})
+		if w != nil {
+			if _, err := w.Write(p.Bytes()); err != nil {
+				w.Close()
+				return err
+			}
 		}
 	}
 	elapsed := time.Since(n)
-	for e, c := range cs {
-		log.Printf("%04x: %8d", e, c)
+	if w != nil {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	ks := make([]errorKey, 0, len(rs))
+	for k := range rs {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i].Less(ks[j])
+	})
+	for _, k := range ks {
+		r := rs[k]
+		log.Printf(crow, k.Category, k.Channel, k.Origin, r.Count, r.Starts.Format(TimeFormat), r.Ends.Format(TimeFormat))
+	}
+	es := make([]uint64, 0, len(cs))
+	for e := range cs {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i] < es[j] })
+	for _, e := range es {
+		if kind.Name == "vmu" {
+			log.Printf("%04x: %8d (%s)", e, cs[e], HRDLError(e))
+		} else {
+			log.Printf("%04x: %8d", e, cs[e])
+		}
 	}
 	log.Printf("%d errors found (%d packets, %s)", err, total, elapsed)
-	return nil
+	errs.Summary()
+	return errs.Err()
+}
+
+type errorKey struct {
+	Category string
+	Channel  VMUChannel
+	Origin   uint8
+}
+
+func (k errorKey) Less(o errorKey) bool {
+	if k.Category != o.Category {
+		return k.Category < o.Category
+	}
+	if k.Channel != o.Channel {
+		return k.Channel < o.Channel
+	}
+	return k.Origin < o.Origin
+}
+
+type errorRange struct {
+	Count  int
+	Starts time.Time
+	Ends   time.Time
+}
+
+func (r *errorRange) Update(t time.Time) {
+	r.Count++
+	if t.Before(r.Starts) {
+		r.Starts = t
+	}
+	if t.After(r.Ends) {
+		r.Ends = t
+	}
 }
 
 func runCount(cmd *cli.Command, args []string) error {
 	const row = "%20s | %20s | %8d | %8d | %8dMB | %8d"
 
-	var kind Kind
+	var (
+		kind   Kind
+		stream Stream
+		filter Filter
+		errs   Errors
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&stream, "m", "realtime or playback stream")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
 	mem := cmd.Flag.Bool("memprofile", false, "profile memory usage")
 	toGPS := cmd.Flag.Bool("g", false, "to gps time")
-	if err := cmd.Flag.Parse(args); err != nil {
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
 
@@ -177,10 +358,11 @@ func runCount(cmd *cli.Command, args []string) error {
 
 	var z Coze
 	now := time.Now()
-	for c := range CountByDay(cmd.Flag.Args(), kind.Decod) {
+	for c := range CountByDay(cmd.Flag.Args(), DecodeByFilter(&filter, DecodeByStream(stream, kind.Decod)), errs.Handle) {
 		z.Update(c.Coze)
 		log.Printf(row, c.When.Add(delta).Format("2006-01-02"), c.Key, c.Count, c.Missing, c.Size>>20, c.Error)
 	}
 	log.Printf("%d packets found, %d missing (%dMB, %s)", z.Count, z.Missing, z.Size>>20, time.Since(now))
-	return nil
+	errs.Summary()
+	return errs.Err()
 }
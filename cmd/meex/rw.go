@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math/rand"
@@ -9,8 +11,8 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
-	"time"
 
+	"github.com/midbel/xxh"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -28,20 +30,21 @@ func Join(d Decoder, rs ...io.ReadSeeker) (io.Reader, error) {
 }
 
 func JoinWith(d Decoder, f SortFunc, rs ...io.ReadSeeker) (io.Reader, error) {
-	ms := make(map[string]io.ReadSeeker)
-	index := make([]*Index, 0, 300*len(rs)*4)
-
 	var (
+		ms    = make(map[string]io.ReadSeeker)
+		heads = make([][]*Index, len(rs))
+		index = make([]*Index, 0, 300*len(rs)*4)
 		group errgroup.Group
 		mu    sync.Mutex
 	)
-	for _, r := range rs {
-		rt := r
+	for j, r := range rs {
+		j, rt := j, r
 		group.Go(func() error {
-			ix, sum, err := indexReader(rt, d)
+			head, ix, sum, err := indexRecords(rt, d)
 			if err == nil {
 				mu.Lock()
 				defer mu.Unlock()
+				heads[j] = head
 				index = append(index, ix...)
 				ms[sum] = rt
 			}
@@ -58,20 +61,199 @@ func JoinWith(d Decoder, f SortFunc, rs ...io.ReadSeeker) (io.Reader, error) {
 	} else {
 		index = f(index)
 	}
-	return &joiner{rs: ms, index: index}, nil
+	var head []*Index
+	for _, h := range heads {
+		head = append(head, h...)
+	}
+	return &joiner{rs: ms, index: flattenIndex(head, index)}, nil
+}
+
+type indexKey struct {
+	Id       int
+	Sequence int
+	When     int64
+}
+
+func (i *Index) key() indexKey {
+	return indexKey{
+		Id:       i.Id,
+		Sequence: i.Sequence,
+		When:     i.Timestamp.UnixNano(),
+	}
+}
+
+// MergeWith merges the packets of rs, skipping the packets already found in a
+// previous reader. Records that can not be decoded are kept (once) after the
+// packet preceding them in their file. MergeWith fails if any reader can not be
+// indexed until its end so that callers never rewrite a file partially.
+func MergeWith(d Decoder, f SortFunc, rs ...io.ReadSeeker) (io.Reader, error) {
+	var (
+		ms    = make(map[string]io.ReadSeeker)
+		seen  = make(map[indexKey]*Index)
+		raws  = make(map[uint64]struct{})
+		head  []*Index
+		index []*Index
+	)
+	uniq := func(ix []*Index) []*Index {
+		vs := ix[:0]
+		for _, i := range ix {
+			if _, ok := raws[i.digest]; ok {
+				continue
+			}
+			raws[i.digest] = struct{}{}
+			vs = append(vs, i)
+		}
+		return vs
+	}
+	for _, r := range rs {
+		hs, ix, sum, err := indexRecords(r, d)
+		if err != nil {
+			return nil, err
+		}
+		ms[sum] = r
+		head = append(head, uniq(hs)...)
+		for _, i := range ix {
+			i.trail = uniq(i.trail)
+			k := i.key()
+			if o, ok := seen[k]; ok {
+				o.trail = append(o.trail, i.trail...)
+				continue
+			}
+			seen[k] = i
+			index = append(index, i)
+		}
+	}
+	if f == nil {
+		sort.SliceStable(index, func(i, j int) bool {
+			return index[i].Timestamp.Before(index[j].Timestamp)
+		})
+	} else {
+		index = f(index)
+	}
+	return &joiner{rs: ms, index: flattenIndex(head, index)}, nil
 }
 
-func indexReader(r io.ReadSeeker, d Decoder) ([]*Index, string, error) {
-	ix, sum := NewReader(r, d).IndexSum()
-	index := make([]*Index, len(ix))
-	for j, i := range ix {
+// indexRecords indexes every record of a RT file. It gives the records that
+// can not be decoded found before the first packet and the packets, each one
+// with the records that can not be decoded following it. Offsets are the
+// positions of the records in r.
+func indexRecords(r io.ReadSeeker, d Decoder) ([]*Index, []*Index, string, error) {
+	if isFramed(d) {
+		return nil, nil, "", fmt.Errorf("packets of framed streams can not be indexed")
+	}
+	var (
+		digest = xxh.New64(0)
+		head   []*Index
+		index  []*Index
+		all    []*Index
+		last   *Index
+	)
+	err := readRecords(io.TeeReader(r, digest), func(offset int, bs []byte) error {
+		i := Index{Offset: offset, Size: len(bs)}
+		all = append(all, &i)
+
+		var p Packet
+		if d != nil {
+			p, _ = d.Decode(bs)
+		}
+		if p == nil {
+			i.digest = xxh.Sum64(bs, 0)
+			if last == nil {
+				head = append(head, &i)
+			} else {
+				last.trail = append(last.trail, &i)
+			}
+			return nil
+		}
+		i.Id, _ = p.Id()
+		i.Sequence = p.Sequence()
+		i.Timestamp = p.Timestamp()
+		index, last = append(index, &i), &i
+		return nil
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	sum := fmt.Sprintf("%x", digest.Sum(nil))
+	for _, i := range all {
 		i.Sum = sum
-		index[j] = i
 	}
 	if _, err := r.Seek(0, io.SeekStart); err != nil {
-		return nil, sum, err
+		return nil, nil, sum, err
+	}
+	return head, index, sum, nil
+}
+
+// readRecords gives each record of a RT file, with its frame, to fn whatever
+// its content. It fails if the last record is incomplete.
+func readRecords(r io.Reader, fn func(int, []byte) error) error {
+	var (
+		rs     = bufio.NewReader(r)
+		buffer = make([]byte, 4096)
+		offset int
+	)
+	for {
+		if _, err := io.ReadFull(rs, buffer[:4]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return recordError(offset, err)
+		}
+		size := int(binary.LittleEndian.Uint32(buffer)) + 4
+		if size > MaxBufferSize {
+			return fmt.Errorf("record at offset %d: too large (%d bytes)", offset, size)
+		}
+		if size > len(buffer) {
+			bs := make([]byte, size)
+			copy(bs, buffer[:4])
+			buffer = bs
+		}
+		if _, err := io.ReadFull(rs, buffer[4:size]); err != nil {
+			return recordError(offset, err)
+		}
+		if err := fn(offset, buffer[:size]); err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+func recordError(offset int, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return fmt.Errorf("record at offset %d: %s", offset, err)
+}
+
+// flattenIndex gives head followed by the packets of index, each one followed
+// by the records that can not be decoded that were following it in its file.
+func flattenIndex(head, index []*Index) []*Index {
+	vs := make([]*Index, 0, len(head)+len(index))
+	vs = append(vs, head...)
+	for _, i := range index {
+		vs = append(vs, i)
+		vs = append(vs, i.trail...)
+	}
+	return vs
+}
+
+func isFramed(d Decoder) bool {
+	for {
+		switch x := d.(type) {
+		case ccsdsDecoder:
+			return x.unframe != nil
+		case Unframer:
+			return true
+		case *byId:
+			d = x.inner
+		case *byStream:
+			d = x.inner
+		case *byFilter:
+			d = x.inner
+		default:
+			return false
+		}
 	}
-	return index, sum, nil
 }
 
 func (j *joiner) Read(bs []byte) (int, error) {
@@ -103,26 +285,37 @@ func Sort(r io.ReadSeeker, d Decoder) (io.Reader, error) {
 }
 
 func SortWith(r io.ReadSeeker, d Decoder, f SortFunc) (io.Reader, error) {
-	ix := NewReader(r, d).Index()
-	if _, err := r.Seek(0, io.SeekStart); err != nil {
+	head, ix, _, err := indexRecords(r, d)
+	if err != nil {
 		return nil, err
 	}
 	if f == nil {
-		sort.Slice(ix, func(i, j int) bool {
+		sort.SliceStable(ix, func(i, j int) bool {
 			return ix[i].Timestamp.Before(ix[j].Timestamp)
 		})
 	} else {
 		ix = f(ix)
 	}
-	return &shuffler{index: ix, reader: r}, nil
+	return &shuffler{index: flattenIndex(head, ix), reader: r}, nil
 }
 
-func Shuffle(rs io.ReadSeeker, d Decoder) (io.Reader, error) {
-	ix := NewReader(rs, d).Index()
-	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+// Shuffle reorders the packets of rs randomly. When window is positive, no
+// packet is moved more than window positions away from its original one.
+func Shuffle(rs io.ReadSeeker, d Decoder, rng *rand.Rand, window int) (io.Reader, error) {
+	head, ix, _, err := indexRecords(rs, d)
+	if err != nil {
 		return nil, err
 	}
-	rand.Shuffle(len(ix), func(i, j int) { ix[i], ix[j] = ix[j], ix[i] })
+	ix = flattenIndex(head, ix)
+	if window <= 0 {
+		rng.Shuffle(len(ix), func(i, j int) { ix[i], ix[j] = ix[j], ix[i] })
+	} else {
+		ks := make(map[*Index]int, len(ix))
+		for i := range ix {
+			ks[ix[i]] = i + rng.Intn(window+1)
+		}
+		sort.SliceStable(ix, func(i, j int) bool { return ks[ix[i]] < ks[ix[j]] })
+	}
 	return &shuffler{index: ix, reader: rs}, nil
 }
 
@@ -144,16 +337,33 @@ func (s *shuffler) Read(bs []byte) (int, error) {
 
 type splitWriters struct {
 	writers []io.WriteCloser
+	weights []float64
+	key     func([]byte) string
+	parts   map[string]int
+	rand    *rand.Rand
 }
 
-func SplitWriter(file string, n int) (io.WriteCloser, error) {
+// SplitWriter writes packets randomly in len(weights) files, each file
+// receiving a share of the packets proportional to its weight. When key is not
+// nil, all the packets with the same key are written in the same file.
+func SplitWriter(file string, weights []float64, key func([]byte) string, rng *rand.Rand) (io.WriteCloser, error) {
+	n := len(weights)
 	if n < 2 {
-		return nil, fmt.Errorf("")
+		return nil, fmt.Errorf("at least two parts expected")
+	}
+	var total float64
+	for _, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("negative weight %f", w)
+		}
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("weights sum to zero")
 	}
 	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
-	rand.Seed(time.Now().Unix())
 
 	ws := make([]io.WriteCloser, n)
 	for i := 0; i < n; i++ {
@@ -167,14 +377,46 @@ func SplitWriter(file string, n int) (io.WriteCloser, error) {
 		}
 		ws[i] = w
 	}
-	return &splitWriters{writers: ws}, nil
+	cs := make([]float64, n)
+	for i, w := range weights {
+		cs[i] = w / total
+		if i > 0 {
+			cs[i] += cs[i-1]
+		}
+	}
+	sw := splitWriters{
+		writers: ws,
+		weights: cs,
+		key:     key,
+		parts:   make(map[string]int),
+		rand:    rng,
+	}
+	return &sw, nil
 }
 
 func (sw *splitWriters) Write(bs []byte) (int, error) {
-	ix := rand.Intn(len(sw.writers))
+	if sw.key == nil {
+		return sw.writers[sw.pick()].Write(bs)
+	}
+	k := sw.key(bs)
+	ix, ok := sw.parts[k]
+	if !ok {
+		ix = sw.pick()
+		sw.parts[k] = ix
+	}
 	return sw.writers[ix].Write(bs)
 }
 
+func (sw *splitWriters) pick() int {
+	v := sw.rand.Float64()
+	for i, w := range sw.weights {
+		if v < w {
+			return i
+		}
+	}
+	return len(sw.weights) - 1
+}
+
 func (sw *splitWriters) Close() error {
 	var err error
 	for _, s := range sw.writers {
@@ -186,27 +428,29 @@ func (sw *splitWriters) Close() error {
 }
 
 type mixReaders struct {
-	rs []Scanner
+	rs   []Scanner
+	rand *rand.Rand
 }
 
-func MixReader(rs ...Scanner) io.Reader {
+func MixReader(rng *rand.Rand, rs ...Scanner) io.Reader {
 	vs := make([]Scanner, len(rs))
 	copy(vs, rs)
 
-	return &mixReaders{vs}
+	return &mixReaders{rs: vs, rand: rng}
 }
 
 func (m *mixReaders) Read(bs []byte) (int, error) {
-	ix := rand.Intn(len(m.rs))
-	if !m.rs[ix].Scan() {
-		if len(m.rs) > 1 {
-			m.rs = append(m.rs[:ix], m.rs[ix+1:]...)
-			ix = (ix + 1) % len(m.rs)
-		} else {
-			return 0, io.EOF
+	for len(m.rs) > 0 {
+		ix := m.rand.Intn(len(m.rs))
+		if m.rs[ix].Scan() {
+			return copy(bs, m.rs[ix].Bytes()), nil
+		}
+		if err := m.rs[ix].Err(); err != nil {
+			return 0, err
 		}
+		m.rs = append(m.rs[:ix], m.rs[ix+1:]...)
 	}
-	return copy(bs, m.rs[ix].Bytes()), m.rs[ix].Err()
+	return 0, io.EOF
 }
 
 type noDuplicateWriter struct {
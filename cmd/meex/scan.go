@@ -10,7 +10,6 @@ import (
 	"hash"
 	"hash/adler32"
 	"io"
-	"os"
 	"strings"
 	"time"
 	"unicode"
@@ -66,6 +65,75 @@ func (i *byId) Decode(bs []byte) (Packet, error) {
 	return p, nil
 }
 
+type byStream struct {
+	stream Stream
+	inner  Decoder
+}
+
+func DecodeByStream(s Stream, d Decoder) Decoder {
+	if s == StreamAny {
+		return d
+	}
+	return &byStream{s, d}
+}
+
+func (s *byStream) Decode(bs []byte) (Packet, error) {
+	if s.inner == nil {
+		return nil, ErrSkip
+	}
+	p, err := s.inner.Decode(bs)
+	if err != nil {
+		return p, err
+	}
+	if !s.stream.Accept(p) {
+		return nil, ErrSkip
+	}
+	return p, nil
+}
+
+type byFilter struct {
+	filter *Filter
+	inner  Decoder
+}
+
+func DecodeByFilter(f *Filter, d Decoder) Decoder {
+	if f == nil || f.match == nil {
+		return d
+	}
+	return &byFilter{f, d}
+}
+
+func (f *byFilter) Decode(bs []byte) (Packet, error) {
+	if f.inner == nil {
+		return nil, ErrSkip
+	}
+	p, err := f.inner.Decode(bs)
+	if err != nil {
+		return p, err
+	}
+	if !f.filter.Match(p) {
+		return nil, ErrSkip
+	}
+	return p, nil
+}
+
+func unframe(d Decoder, r io.Reader) io.Reader {
+	for {
+		switch x := d.(type) {
+		case Unframer:
+			return x.Unframe(r)
+		case *byId:
+			d = x.inner
+		case *byStream:
+			d = x.inner
+		case *byFilter:
+			d = x.inner
+		default:
+			return r
+		}
+	}
+}
+
 type DecoderFunc func([]byte) (Packet, error)
 
 func (d DecoderFunc) Decode(bs []byte) (Packet, error) {
@@ -329,6 +397,48 @@ func (c *CCSDSHeader) Sequence() int {
 	return int(c.Fragment & 0x3FFF)
 }
 
+func (c *CCSDSHeader) PacketVersion() int {
+	return int(c.Version >> 13)
+}
+
+func (c *CCSDSHeader) PacketType() int {
+	return int(c.Version>>12) & 0x1
+}
+
+func (c *CCSDSHeader) Secondary() bool {
+	return c.Version&0x0800 != 0
+}
+
+func (c *CCSDSHeader) Grouping() Grouping {
+	return Grouping(c.Fragment >> 14)
+}
+
+func (c *CCSDSHeader) Size() int {
+	return CCSDSHeaderLen + int(c.Length) + 1
+}
+
+type Grouping uint8
+
+const (
+	GroupContinuation Grouping = iota
+	GroupFirst
+	GroupLast
+	GroupStandalone
+)
+
+func (g Grouping) String() string {
+	switch g {
+	case GroupContinuation:
+		return "continuation"
+	case GroupFirst:
+		return "first"
+	case GroupLast:
+		return "last"
+	default:
+		return "standalone"
+	}
+}
+
 type ESAPacketType uint8
 
 const (
@@ -536,7 +646,7 @@ func (t *TMPacket) Bytes() []byte {
 
 type HRDLHeader struct {
 	Size        uint32
-	Error       uint16
+	Error       HRDLError
 	Payload     uint8
 	Channel     uint8
 	Acquisition time.Time
@@ -571,6 +681,29 @@ func (h *HRDLHeader) UnmarshalBinary(bs []byte) error {
 	return nil
 }
 
+// HRDLError is the error word of the HRDL header. The meaning of its bits is
+// not documented: they are reported by their number only.
+type HRDLError uint16
+
+const ErrorChecksum = "checksum"
+
+func (e HRDLError) Flags() []string {
+	var fs []string
+	for i := uint(0); i < 16; i++ {
+		if e&(1<<i) != 0 {
+			fs = append(fs, fmt.Sprintf("bit%d", i))
+		}
+	}
+	return fs
+}
+
+func (e HRDLError) String() string {
+	if e == 0 {
+		return "-"
+	}
+	return strings.Join(e.Flags(), "|")
+}
+
 type VMUChannel uint8
 
 const (
@@ -600,6 +733,7 @@ type VMUCommonHeader struct {
 	UPI      [32]byte
 
 	Valid bool
+	Live  bool
 }
 
 func (v *VMUCommonHeader) Id() (int, int) {
@@ -650,6 +784,10 @@ func (v *VMUCommonHeader) Error() bool {
 	return !v.Valid
 }
 
+func (v *VMUCommonHeader) Realtime() bool {
+	return v.Live
+}
+
 func (v *VMUCommonHeader) Less(o Packet) bool {
 	return v.Timestamp().Before(o.Timestamp())
 }
@@ -701,7 +839,7 @@ type Image struct {
 	Payload []byte
 }
 
-func decodeImage(bs []byte, valid bool) (*Image, error) {
+func decodeImage(bs []byte, valid bool, origin uint8) (*Image, error) {
 	r := bytes.NewReader(bs)
 	var (
 		c VMUCommonHeader
@@ -726,6 +864,7 @@ func decodeImage(bs []byte, valid bool) (*Image, error) {
 		return nil, err
 	}
 	c.Valid = valid
+	c.Live = c.Origin == origin
 
 	i := Image{
 		VMUCommonHeader: &c,
@@ -764,7 +903,7 @@ type Table struct {
 	Payload []byte
 }
 
-func decodeTable(bs []byte, valid bool) (*Table, error) {
+func decodeTable(bs []byte, valid bool, origin uint8) (*Table, error) {
 	r := bytes.NewReader(bs)
 
 	var c VMUCommonHeader
@@ -779,6 +918,7 @@ func decodeTable(bs []byte, valid bool) (*Table, error) {
 		return nil, err
 	}
 	c.Valid = valid
+	c.Live = c.Origin == origin
 
 	t := Table{
 		VMUCommonHeader: &c,
@@ -855,8 +995,15 @@ type VMUPacket struct {
 	Payload []byte
 	Sum     uint32
 	Control uint32
+
+	live       bool
+	classified bool
 }
 
+// vmuOriginOffset is the offset of the origin in the common header of the
+// images and tables carried by VMU packets.
+const vmuOriginOffset = 23
+
 func DecodeVMU() Decoder {
 	return DecoderFunc(decodeVMU)
 }
@@ -871,7 +1018,14 @@ func DecodeHRD() Decoder {
 		if !ok {
 			return nil, fmt.Errorf("can not decode VMU packet")
 		}
-		return v.Data()
+		hr, err := v.Data()
+		if err != nil {
+			return nil, err
+		}
+		if hr == nil {
+			return nil, ErrUnknownKind
+		}
+		return hr, nil
 	}
 	return DecoderFunc(f)
 }
@@ -894,15 +1048,39 @@ func decodeVMU(bs []byte) (Packet, error) {
 		HRH:     &h,
 		VMU:     &v,
 		Payload: bs,
-		Sum:     binary.LittleEndian.Uint32(bs[len(bs)-4:]),
 	}
-	for i := HRDLHeaderLen + 8; i < len(bs)-4; i++ {
-		p.Control += uint32(bs[i])
+	switch ix := HRDLHeaderLen + VMUHeaderLen + vmuOriginOffset; v.Channel {
+	case ChannelVic1, ChannelVic2, ChannelLRSD:
+		if ix < len(bs) {
+			p.live, p.classified = bs[ix] == v.Origin, true
+		}
+	}
+	sum, stored, err := vmuChecksum(bs)
+	if err != nil {
+		return nil, err
 	}
+	p.Control, p.Sum = sum, stored
 
 	return &p, nil
 }
 
+// vmuChecksum gives the sum of the bytes of a VMU packet (from the VMU
+// header, sync word excluded, up to the trailer) and the sum stored in its
+// trailer.
+func vmuChecksum(bs []byte) (uint32, uint32, error) {
+	var (
+		sum uint32
+		j   = len(bs) - 4
+	)
+	if j < HRDLHeaderLen+8 {
+		return 0, 0, ErrShortBuffer
+	}
+	for _, b := range bs[HRDLHeaderLen+8 : j] {
+		sum += uint32(b)
+	}
+	return sum, binary.LittleEndian.Uint32(bs[j:]), nil
+}
+
 func (v *VMUPacket) Data() (HRPacket, error) {
 	var (
 		d   HRPacket
@@ -911,13 +1089,27 @@ func (v *VMUPacket) Data() (HRPacket, error) {
 	switch valid := v.Control == v.Sum; v.VMU.Channel {
 	default:
 	case ChannelVic1, ChannelVic2:
-		d, err = decodeImage(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid)
+		d, err = decodeImage(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid, v.VMU.Origin)
 	case ChannelLRSD:
-		d, err = decodeTable(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid)
+		d, err = decodeTable(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid, v.VMU.Origin)
 	}
 	return d, err
 }
 
+// Realtime reports whether the data carried by the packet have the origin of
+// the packet. It is set when the packet is decoded and is only meaningful when
+// Classified is true.
+func (v *VMUPacket) Realtime() bool {
+	return v.live
+}
+
+// Classified reports whether the packet can be told realtime or playback:
+// packets of unknown channels or too short to carry the origin of their data
+// are not.
+func (v *VMUPacket) Classified() bool {
+	return v.classified
+}
+
 func (v *VMUPacket) Error() bool {
 	if v.HRH.Error != 0 {
 		return true
@@ -925,6 +1117,14 @@ func (v *VMUPacket) Error() bool {
 	return v.Sum != v.Control
 }
 
+func (v *VMUPacket) Errors() []string {
+	es := v.HRH.Error.Flags()
+	if v.Sum != v.Control {
+		es = append(es, ErrorChecksum)
+	}
+	return es
+}
+
 func (v *VMUPacket) PacketInfo() *Info {
 	return &Info{
 		Id:       int(v.VMU.Channel),
@@ -992,15 +1192,8 @@ func (v *VMUPacket) Bytes() []byte {
 }
 
 func (v *VMUPacket) Valid() bool {
-	var sum uint32
-
-	i := HRDLHeaderLen + 8
-	j := len(v.Payload) - binary.Size(sum)
-
-	for _, b := range v.Payload[i:j] {
-		sum += uint32(b)
-	}
-	return sum == binary.LittleEndian.Uint32(v.Payload[j:])
+	sum, stored, err := vmuChecksum(v.Payload)
+	return err == nil && sum == stored
 }
 
 type Index struct {
@@ -1011,6 +1204,11 @@ type Index struct {
 	Timestamp time.Time
 
 	Sum string
+
+	// records following the packet that can not be decoded and their digest
+	// when the index is one of them.
+	trail  []*Index
+	digest uint64
 }
 
 type Reader struct {
@@ -1025,7 +1223,12 @@ type Reader struct {
 	buffer []byte
 	offset int
 
-	queue chan Packet
+	position  int64
+	last      int64
+	truncated bool
+
+	handler ErrorHandler
+	queue   chan Packet
 }
 
 const maxBufferSize = 32 << 20
@@ -1042,10 +1245,19 @@ func NewReader(r io.Reader, d Decoder) *Reader {
 
 func (r *Reader) Reset(rs io.Reader) {
 	r.digest.Reset()
-	r.reader = io.TeeReader(rs, r.digest)
+	r.reader = unframe(r.decoder, io.TeeReader(rs, r.digest))
+	r.position, r.last, r.truncated = 0, 0, false
 	// r.reader = rs
 }
 
+func (r *Reader) Offset() int64 {
+	return r.last
+}
+
+func (r *Reader) OnError(fn ErrorHandler) {
+	r.handler = fn
+}
+
 func (r *Reader) IndexSum() ([]*Index, string) {
 	return r.indexSum()
 }
@@ -1102,27 +1314,57 @@ func (r *Reader) Gaps() <-chan *Gap {
 }
 
 func (r *Reader) Next() (Packet, error) {
+	if r.truncated {
+		return nil, io.EOF
+	}
 	if diff := maxBufferSize - r.offset; diff < 1024 {
 		r.offset = 0
 	}
-	if _, err := r.reader.Read(r.buffer[r.offset : r.offset+4]); err != nil {
-		return nil, err
+	r.mark()
+	if _, err := io.ReadFull(r.reader, r.buffer[r.offset:r.offset+4]); err != nil {
+		return nil, r.readError(err)
 	}
+	r.mark()
 	size := int(binary.LittleEndian.Uint32(r.buffer[r.offset:]))
 	if diff := maxBufferSize - (r.offset + 4); size >= diff {
 		copy(r.buffer, r.buffer[r.offset:r.offset+4])
 		r.offset = 0
 	}
 
-	if _, err := r.reader.Read(r.buffer[r.offset+4 : r.offset+size+4]); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(r.reader, r.buffer[r.offset+4:r.offset+size+4]); err != nil {
+		return nil, r.readError(err)
 	}
+	r.position += int64(size) + 4
 	if r.decoder == nil {
 		return nil, ErrSkip
 	}
 	offset := r.offset
 	r.offset += size + 4
-	return r.decoder.Decode(r.buffer[offset : offset+size+4])
+	p, err := r.decoder.Decode(r.buffer[offset : offset+size+4])
+	if err != nil && err != ErrSkip {
+		err = &PacketError{Provenance: Provenance{Offset: r.last}, Err: err}
+	}
+	return p, err
+}
+
+// mark records the offset of the record being read. Records of framed streams
+// are given at their offset in the file and not in the unframed stream.
+func (r *Reader) mark() {
+	r.last = r.position
+	if p, ok := r.reader.(Positioner); ok {
+		r.last = p.Position()
+	}
+}
+
+// readError reports a truncated record. Nothing can be read after it: the
+// reader ends at the next call to Next even if the underlying reader keeps
+// failing (as the decompressors do).
+func (r *Reader) readError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		r.truncated = true
+		return &PacketError{Provenance: Provenance{Offset: r.last}, Err: ErrTruncated}
+	}
+	return err
 }
 
 func (r *Reader) Packets() <-chan Packet {
@@ -1140,11 +1382,22 @@ func (r *Reader) packets() {
 	}()
 	for {
 		p, err := r.Next()
-		if err == io.EOF {
+		switch err {
+		case nil:
+			r.queue <- p
+			continue
+		case io.EOF:
 			return
+		case ErrSkip:
+			continue
 		}
-		if err == nil {
-			r.queue <- p
+		if r.handler != nil {
+			if e := r.handler(err); e != nil {
+				return
+			}
+		}
+		if _, ok := err.(*PacketError); !ok {
+			return
 		}
 	}
 }
@@ -1155,7 +1408,7 @@ type scanner struct {
 }
 
 func ScanFile(f string) (ScanCloser, error) {
-	r, err := os.Open(f)
+	r, err := OpenSource(f)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var serveCommand = &cli.Command{
+	Usage: "serve [-k type] [-d datadir] [-r range] <addr>",
+	Short: "query the RT archive over HTTP",
+	Run:   runServe,
+}
+
+func runServe(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	datadir := cmd.Flag.String("d", "", "data directory")
+	span := cmd.Flag.Duration("r", Day, "maximum time range of a query")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if *datadir == "" {
+		return ErrNoDatadir
+	}
+	s := server{
+		Root: *datadir,
+		Kind: kind,
+		Span: *span,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/packets", s.handle(s.packets))
+	mux.HandleFunc("/gaps", s.handle(s.gaps))
+	mux.HandleFunc("/counts", s.handle(s.counts))
+	mux.HandleFunc("/files", s.handle(s.files))
+
+	log.Printf("serving %s on %s", *datadir, cmd.Flag.Arg(0))
+	return http.ListenAndServe(cmd.Flag.Arg(0), mux)
+}
+
+type server struct {
+	Root string
+	Kind Kind
+	Span time.Duration
+}
+
+// query holds the parameters shared by all the endpoints: kind, from, to and
+// filter. Times are given in RFC3339 and are compared to the time used to
+// dispatch packets in the archive.
+type query struct {
+	Kind   Kind
+	Filter Filter
+	From   time.Time
+	To     time.Time
+	Format string
+
+	errs Errors
+}
+
+func (q *query) Paths(root string) []string {
+	return existingPaths(root, q.From, q.To)
+}
+
+func (q *query) Decoder() Decoder {
+	return DecodeByFilter(&q.Filter, q.Kind.Decod)
+}
+
+func (q *query) Accept(p Packet) bool {
+	w := p.Timestamp().Add(GPS.Sub(UNIX))
+	return !w.Before(q.From) && w.Before(q.To)
+}
+
+func (s server) parseQuery(r *http.Request) (*query, error) {
+	var (
+		vs  = r.URL.Query()
+		q   = query{Kind: s.Kind, Format: vs.Get("format")}
+		err error
+	)
+	if k := vs.Get("kind"); k != "" {
+		if err := q.Kind.Set(k); err != nil {
+			return nil, err
+		}
+	}
+	if q.Kind.Decod == nil {
+		return nil, fmt.Errorf("no packet type provided")
+	}
+	if err := q.Filter.Set(vs.Get("filter")); err != nil {
+		return nil, err
+	}
+	if q.From, err = time.Parse(time.RFC3339, vs.Get("from")); err != nil {
+		return nil, fmt.Errorf("from: %s", err)
+	}
+	q.To = q.From.Add(time.Hour)
+	if t := vs.Get("to"); t != "" {
+		if q.To, err = time.Parse(time.RFC3339, t); err != nil {
+			return nil, fmt.Errorf("to: %s", err)
+		}
+	}
+	q.From, q.To = q.From.UTC(), q.To.UTC()
+	switch d := q.To.Sub(q.From); {
+	case d <= 0:
+		return nil, fmt.Errorf("empty time range")
+	case s.Span > 0 && d > s.Span:
+		return nil, fmt.Errorf("time range too large (max %s)", s.Span)
+	}
+	return &q, nil
+}
+
+type handlerFunc func(context.Context, http.ResponseWriter, *query) error
+
+func (s server) handle(fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		q, err := s.parseQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		if err := fn(r.Context(), w, q); err != nil && r.Context().Err() == nil {
+			log.Printf("%s %s: %s", r.Method, r.URL, err)
+		}
+		q.errs.Summary()
+		log.Printf("%s %s (%s)", r.Method, r.URL, time.Since(now))
+	}
+}
+
+func (s server) packets(ctx context.Context, w http.ResponseWriter, q *query) error {
+	var write func(*TracedPacket) error
+	switch strings.ToLower(q.Format) {
+	case "", "rt":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		write = func(p *TracedPacket) error {
+			_, err := w.Write(p.Bytes())
+			return err
+		}
+	case "json", "ndjson":
+		e := newEncoder(w)
+		write = func(p *TracedPacket) error {
+			return e.Encode(p.PacketInfo())
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %s", q.Format), http.StatusBadRequest)
+		return nil
+	}
+	for p := range WalkContext(ctx, q.Paths(s.Root), q.Decoder(), q.errs.Handle) {
+		if !q.Accept(p.Packet) {
+			continue
+		}
+		if err := write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s server) gaps(ctx context.Context, w http.ResponseWriter, q *query) error {
+	e := newEncoder(w)
+	for g := range GapsContext(ctx, q.Paths(s.Root), q.Decoder(), q.errs.Handle) {
+		if g.Ends.Add(GPS.Sub(UNIX)).Before(q.From) || !g.Starts.Add(GPS.Sub(UNIX)).Before(q.To) {
+			continue
+		}
+		r := struct {
+			*Gap
+			Key     string `json:"key"`
+			Missing int    `json:"missing"`
+		}{
+			Gap:     g.Gap,
+			Key:     g.Key,
+			Missing: g.Missing(),
+		}
+		if err := e.Encode(r); err != nil {
+			return err
+		}
+		e.Flush()
+	}
+	return nil
+}
+
+func (s server) counts(ctx context.Context, w http.ResponseWriter, q *query) error {
+	e := newEncoder(w)
+	for c := range CountByDayContext(ctx, q.Paths(s.Root), q.Decoder(), q.errs.Handle) {
+		r := struct {
+			*Coze
+			Key  string    `json:"key"`
+			When time.Time `json:"day"`
+		}{
+			Coze: c.Coze,
+			Key:  c.Key,
+			When: c.When,
+		}
+		if err := e.Encode(r); err != nil {
+			return err
+		}
+		e.Flush()
+	}
+	return nil
+}
+
+func (s server) files(ctx context.Context, w http.ResponseWriter, q *query) error {
+	type file struct {
+		File    string    `json:"file"`
+		Starts  time.Time `json:"dtstart"`
+		Ends    time.Time `json:"dtend"`
+		Size    int64     `json:"bytes"`
+		ModTime time.Time `json:"modtime"`
+	}
+	e := newEncoder(w)
+	for _, d := range q.Paths(s.Root) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		is, err := readDir(d)
+		if err != nil {
+			return err
+		}
+		for _, i := range is {
+			p := filepath.Join(d, i.Name())
+			_, starts, ends := parseTimePath(p)
+			if starts.IsZero() || !ends.After(q.From) || !starts.Before(q.To) {
+				continue
+			}
+			rel, _ := filepath.Rel(s.Root, p)
+			f := file{
+				File:    filepath.ToSlash(rel),
+				Starts:  starts,
+				Ends:    ends,
+				Size:    i.Size(),
+				ModTime: i.ModTime().UTC(),
+			}
+			if err := e.Encode(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDir(d string) ([]os.FileInfo, error) {
+	f, err := os.Open(d)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	is, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	vs := is[:0]
+	for _, i := range is {
+		if i.Mode().IsRegular() && !strings.HasPrefix(i.Name(), ".") {
+			vs = append(vs, i)
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Name() < vs[j].Name() })
+	return vs, nil
+}
+
+type encoder struct {
+	*json.Encoder
+	w http.ResponseWriter
+}
+
+func newEncoder(w http.ResponseWriter) *encoder {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return &encoder{Encoder: json.NewEncoder(w), w: w}
+}
+
+func (e *encoder) Flush() {
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
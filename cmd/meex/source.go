@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const Stdin = "-"
+
+func WalkSources(path string, fn func(string, io.Reader) error) error {
+	if path == Stdin {
+		return walkSource(Stdin, os.Stdin, fn)
+	}
+	return filepath.Walk(path, func(p string, i os.FileInfo, err error) error {
+		if err != nil || i.IsDir() {
+			return err
+		}
+		r, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return walkSource(p, r, fn)
+	})
+}
+
+func walkSource(name string, r io.Reader, fn func(string, io.Reader) error) error {
+	rc, err := NewDecompressor(r)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	rs := bufio.NewReader(rc)
+	if !isTar(rs) {
+		return fn(name, rs)
+	}
+	tr := tar.NewReader(rs)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !h.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		mr, err := NewDecompressor(tr)
+		if err != nil {
+			return err
+		}
+		err = fn(name+":"+h.Name, mr)
+		mr.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func OpenSource(file string) (io.ReadCloser, error) {
+	var (
+		rc  io.ReadCloser
+		err error
+	)
+	if file == Stdin {
+		rc, err = NewDecompressor(os.Stdin)
+	} else {
+		rc, err = OpenFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rs := bufio.NewReader(rc)
+	if !isTar(rs) {
+		return &readCloser{Reader: rs, closers: []io.Closer{rc}}, nil
+	}
+	t := tarStream{reader: tar.NewReader(rs)}
+	return &readCloser{Reader: &t, closers: []io.Closer{&t, rc}}, nil
+}
+
+func isTar(r *bufio.Reader) bool {
+	bs, _ := r.Peek(512)
+	return len(bs) == 512 && string(bs[257:262]) == "ustar"
+}
+
+type tarStream struct {
+	reader *tar.Reader
+	member io.ReadCloser
+}
+
+func (t *tarStream) Read(bs []byte) (int, error) {
+	for {
+		if t.member == nil {
+			h, err := t.reader.Next()
+			if err != nil {
+				return 0, err
+			}
+			if !h.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			if t.member, err = NewDecompressor(t.reader); err != nil {
+				return 0, err
+			}
+		}
+		n, err := t.member.Read(bs)
+		if err == io.EOF {
+			t.member.Close()
+			t.member = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (t *tarStream) Close() error {
+	if t.member == nil {
+		return nil
+	}
+	return t.member.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Sources counts the datagrams received by store per listener and per sender.
+// Datagrams are decoded to estimate the number of packets lost from their
+// sequence counters.
+type Sources struct {
+	kind    Kind
+	metrics *Metrics
+	ports   bool
+
+	mu    sync.Mutex
+	stats map[sourceKey]*sourceStats
+}
+
+type sourceKey struct {
+	Listener string
+	Addr     string
+}
+
+type sourceStats struct {
+	Datagrams uint64
+	Bytes     uint64
+	Oversized uint64
+	Invalid   uint64
+	Missing   uint64
+
+	last map[string]Packet
+}
+
+// NewSources creates the statistics of the sources of the datagrams. Sources
+// are identified by their address and, when ports is set, by their port.
+func NewSources(k Kind, m *Metrics, ports bool) *Sources {
+	return &Sources{
+		kind:    k,
+		metrics: m,
+		ports:   ports,
+		stats:   make(map[sourceKey]*sourceStats),
+	}
+}
+
+// Update records a datagram received from src and the packet decoded from it.
+func (s *Sources) Update(listener string, src *net.UDPAddr, bs []byte, p Packet, err error) {
+	s.metrics.Datagram(s.label(src), false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.statsOf(listener, src)
+	st.Datagrams++
+	st.Bytes += uint64(len(bs))
+
+	if err != nil || p == nil {
+		if err != nil && err != ErrSkip {
+			st.Invalid++
+		}
+		return
+	}
+	key := defaultPacketKey(p)
+	if g := p.Diff(st.last[key]); g != nil {
+		st.Missing += uint64(g.Missing())
+	}
+	st.last[key] = p
+}
+
+func (s *Sources) Oversized(listener string, src *net.UDPAddr) {
+	s.metrics.Datagram(s.label(src), true)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statsOf(listener, src).Oversized++
+}
+
+func (s *Sources) Report() {
+	const row = "%-21s | %-21s | %8d | %10d | %6d | %6d | %6d"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ks := make([]sourceKey, 0, len(s.stats))
+	for k := range s.stats {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if ks[i].Listener != ks[j].Listener {
+			return ks[i].Listener < ks[j].Listener
+		}
+		return ks[i].Addr < ks[j].Addr
+	})
+	for _, k := range ks {
+		st := s.stats[k]
+		log.Printf(row, k.Listener, k.Addr, st.Datagrams, st.Bytes, st.Oversized, st.Invalid, st.Missing)
+	}
+}
+
+func (s *Sources) statsOf(listener string, src *net.UDPAddr) *sourceStats {
+	k := sourceKey{Listener: listener, Addr: s.label(src)}
+	st, ok := s.stats[k]
+	if !ok {
+		st = &sourceStats{last: make(map[string]Packet)}
+		s.stats[k] = st
+	}
+	return st
+}
+
+func (s *Sources) label(src *net.UDPAddr) string {
+	if s.ports {
+		return src.String()
+	}
+	return src.IP.String()
+}
+
+// decodeDatagram decodes data as received by store, before being framed in the
+// RT format.
+func decodeDatagram(k Kind, bs []byte) (Packet, error) {
+	vs, err := k.Frame(bs)
+	if err != nil {
+		return nil, err
+	}
+	return k.Decod.Decode(vs)
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var splitCommand = &cli.Command{
+	Usage: "split [-k type] [-w filter] [-i interval] [-c count] [-s size] [-b key] [-o template] [-n files] [-strict] <file...>",
+	Short: "split packets from RT file(s) by time, count, size or key",
+	Run:   runSplit,
+}
+
+var catCommand = &cli.Command{
+	Usage: "cat [-k type] [-w filter] [-o output] [-s sort] [-u uniq] [-strict] <file...>",
+	Short: "concatenate packets from RT file(s)",
+	Run:   runCat,
+}
+
+const (
+	DefaultTemplate    = "{kind}_{start}_{part}.dat"
+	DefaultKeyTemplate = "{kind}_{key}_{start}_{part}.dat"
+)
+
+func runSplit(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		filter Filter
+		size   Size
+		errs   Errors
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.Var(&size, "s", "maximum size of files")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	interval := cmd.Flag.Duration("i", 0, "interval")
+	count := cmd.Flag.Int("c", 0, "maximum number of packets per file")
+	key := cmd.Flag.String("b", "", "split by key")
+	template := cmd.Flag.String("o", "", "template of file names")
+	limit := cmd.Flag.Int("n", DefaultOpenFiles, "maximum number of open files")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if *template == "" {
+		*template = DefaultTemplate
+		if *key != "" {
+			*template = DefaultKeyTemplate
+		}
+	}
+	s, err := NewSplitter(kind, *template, *key, *interval, *count, int64(size), *limit)
+	if err != nil {
+		return err
+	}
+	for p := range WalkTraced(cmd.Flag.Args(), DecodeByFilter(&filter, kind.Decod), errs.Handle) {
+		if err := s.Split(p.Packet); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	const row = "%-48s | %8d | %10d | %s | %s"
+	for _, f := range s.Files {
+		log.Printf(row, f.File, f.Count, f.Size, f.First.Format(TimeFormat), f.Last.Format(TimeFormat))
+	}
+	errs.Summary()
+	return errs.Err()
+}
+
+// Splitter writes packets in files created from a template. A new file is
+// started for each window of the interval, each value of the key and each time
+// the number of packets or the size of the current file would exceed the
+// maximum given. Times are archive times, as used by dispatch.
+//
+// Placeholders of the template are written between braces with an optional
+// format after a colon:
+//
+//	{kind}         name of the packet type
+//	{key}          value of the key used to split packets
+//	{start:layout} start of the window or time of the first packet
+//	{end:layout}   end of the window or time of the last packet
+//	{part:%04d}    number of the file for the same key and window
+//	{apid:%d}      any field of the filter language, of the first packet
+//
+// Files whose names are the same are concatenated.
+type Splitter struct {
+	Files []SplitFile
+
+	kind     Kind
+	template *Template
+	key      string
+	field    field
+	interval time.Duration
+	count    int
+	size     int64
+
+	tmp     string
+	limit   int
+	buckets map[string]*splitBucket
+	parts   []*splitPart
+	opened  *list.List
+}
+
+type SplitFile struct {
+	File  string
+	Count int
+	Size  int64
+	First time.Time
+	Last  time.Time
+}
+
+type splitBucket struct {
+	part  *splitPart
+	index int
+}
+
+type splitPart struct {
+	SplitFile
+
+	key    string
+	index  int
+	window time.Time
+	values map[string]interface{}
+
+	temp   string
+	writer *os.File
+	elem   *list.Element
+}
+
+func NewSplitter(k Kind, template, key string, interval time.Duration, count int, size int64, limit int) (*Splitter, error) {
+	if k.Decod == nil {
+		return nil, fmt.Errorf("no packet type provided")
+	}
+	if interval <= 0 && count <= 0 && size <= 0 && key == "" {
+		return nil, fmt.Errorf("no interval, count, size or key provided")
+	}
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	s := Splitter{
+		kind:     k,
+		template: t,
+		key:      key,
+		interval: interval,
+		count:    count,
+		size:     size,
+		limit:    limit,
+		buckets:  make(map[string]*splitBucket),
+		opened:   list.New(),
+	}
+	if s.limit <= 0 {
+		s.limit = DefaultOpenFiles
+	}
+	if key != "" {
+		if s.field, err = lookupField(key); err != nil {
+			return nil, err
+		}
+	}
+	dir := t.Dir()
+	if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if s.tmp, err = ioutil.TempDir(dir, ".meex-split-"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Splitter) Split(p Packet) error {
+	var (
+		when = p.Timestamp().Add(GPS.Sub(UNIX))
+		bs   = p.Bytes()
+		key  string
+		win  time.Time
+	)
+	if s.key != "" {
+		key = "none"
+		if v, ok := s.field.get(p); ok {
+			key = fmt.Sprint(v)
+		}
+	}
+	if s.interval > 0 {
+		win = when.Truncate(s.interval)
+	}
+	id := key + "/" + win.Format(time.RFC3339Nano)
+	b, ok := s.buckets[id]
+	if !ok {
+		b = &splitBucket{}
+		s.buckets[id] = b
+	}
+	if b.part == nil || s.full(b.part, len(bs)) {
+		b.index++
+		b.part = &splitPart{
+			key:    key,
+			index:  b.index,
+			window: win,
+			values: s.template.Values(p),
+		}
+		b.part.First, b.part.Last = when, when
+		s.parts = append(s.parts, b.part)
+	}
+	f := b.part
+	if err := s.open(f); err != nil {
+		return err
+	}
+	if _, err := f.writer.Write(bs); err != nil {
+		return err
+	}
+	f.Count++
+	f.Size += int64(len(bs))
+	if when.Before(f.First) {
+		f.First = when
+	}
+	if when.After(f.Last) {
+		f.Last = when
+	}
+	return nil
+}
+
+func (s *Splitter) full(f *splitPart, n int) bool {
+	if s.count > 0 && f.Count >= s.count {
+		return true
+	}
+	return s.size > 0 && f.Size > 0 && f.Size+int64(n) > s.size
+}
+
+func (s *Splitter) open(f *splitPart) error {
+	if f.temp == "" {
+		w, err := ioutil.TempFile(s.tmp, "part")
+		if err != nil {
+			return err
+		}
+		f.temp, f.writer = w.Name(), w
+	}
+	if f.writer == nil {
+		w, err := os.OpenFile(f.temp, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		f.writer = w
+	}
+	if f.elem == nil {
+		f.elem = s.opened.PushFront(f)
+	} else {
+		s.opened.MoveToFront(f.elem)
+	}
+	for s.opened.Len() > s.limit {
+		e := s.opened.Back()
+		o := s.opened.Remove(e).(*splitPart)
+		o.elem = nil
+		if err := o.writer.Close(); err != nil {
+			return err
+		}
+		o.writer = nil
+	}
+	return nil
+}
+
+// Close gives their names to the files written and moves them to their final
+// location.
+func (s *Splitter) Close() error {
+	defer os.RemoveAll(s.tmp)
+
+	var err error
+	for _, f := range s.parts {
+		if f.writer != nil {
+			if e := f.writer.Close(); err == nil && e != nil {
+				err = e
+			}
+			f.writer = nil
+		}
+	}
+	s.opened.Init()
+	if err != nil {
+		return err
+	}
+
+	var (
+		names  []string
+		groups = make(map[string][]*splitPart)
+		buffer = make([]byte, MaxBufferSize)
+	)
+	for _, f := range s.parts {
+		name := s.template.Render(s.kind.Name, s.interval, f)
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], f)
+	}
+	for _, n := range names {
+		file := SplitFile{File: n}
+		if err := s.write(&file, groups[n], buffer); err != nil {
+			return err
+		}
+		s.Files = append(s.Files, file)
+	}
+	return nil
+}
+
+func (s *Splitter) write(file *SplitFile, ps []*splitPart, buffer []byte) error {
+	rs := make([]io.Reader, 0, len(ps))
+	for _, f := range ps {
+		r, err := os.Open(f.temp)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		rs = append(rs, r)
+
+		if file.Count == 0 || f.First.Before(file.First) {
+			file.First = f.First
+		}
+		if f.Last.After(file.Last) {
+			file.Last = f.Last
+		}
+		file.Count += f.Count
+		file.Size += f.Size
+	}
+	if err := os.MkdirAll(filepath.Dir(file.File), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return writeFileAtomic(file.File, io.MultiReader(rs...), buffer)
+}
+
+// Template gives the names of the files created by split.
+type Template struct {
+	text   string
+	chunks []templateChunk
+}
+
+type templateChunk struct {
+	Literal string
+	Name    string
+	Format  string
+	field   field
+}
+
+func ParseTemplate(str string) (*Template, error) {
+	t := Template{text: str}
+	for str != "" {
+		ix := strings.IndexByte(str, '{')
+		if ix < 0 {
+			t.chunks = append(t.chunks, templateChunk{Literal: str})
+			break
+		}
+		if ix > 0 {
+			t.chunks = append(t.chunks, templateChunk{Literal: str[:ix]})
+		}
+		str = str[ix+1:]
+		if ix = strings.IndexByte(str, '}'); ix < 0 {
+			return nil, fmt.Errorf("template %s: missing closing brace", t.text)
+		}
+		c := templateChunk{Name: str[:ix]}
+		if x := strings.IndexByte(c.Name, ':'); x >= 0 {
+			c.Name, c.Format = c.Name[:x], c.Name[x+1:]
+		}
+		c.Name = strings.ToLower(strings.TrimSpace(c.Name))
+		switch c.Name {
+		case "kind", "key":
+		case "start", "end":
+			if c.Format == "" {
+				c.Format = "20060102T150405"
+			}
+		case "part":
+			if c.Format == "" {
+				c.Format = "%04d"
+			}
+		default:
+			f, err := lookupField(c.Name)
+			if err != nil {
+				return nil, fmt.Errorf("template %s: %s", t.text, err)
+			}
+			c.field = f
+		}
+		t.chunks = append(t.chunks, c)
+		str = str[ix+1:]
+	}
+	return &t, nil
+}
+
+// Dir gives the directory of the files created with the template up to its
+// first placeholder.
+func (t *Template) Dir() string {
+	str := t.text
+	if ix := strings.IndexByte(str, '{'); ix >= 0 {
+		str = str[:ix]
+	}
+	if !strings.HasSuffix(str, string(filepath.Separator)) {
+		str = filepath.Dir(str)
+	}
+	return filepath.Clean(str)
+}
+
+// Values gives the values of the fields of p used by the template.
+func (t *Template) Values(p Packet) map[string]interface{} {
+	vs := make(map[string]interface{})
+	for _, c := range t.chunks {
+		if c.field.get == nil {
+			continue
+		}
+		if v, ok := c.field.get(p); ok {
+			vs[c.Name] = v
+		}
+	}
+	return vs
+}
+
+func (t *Template) Render(kind string, interval time.Duration, f *splitPart) string {
+	var buf strings.Builder
+	for _, c := range t.chunks {
+		var str string
+		switch c.Name {
+		case "":
+			buf.WriteString(c.Literal)
+			continue
+		case "kind":
+			str = kind
+		case "key":
+			str = f.key
+		case "start":
+			if !f.window.IsZero() {
+				str = f.window.Format(c.Format)
+			} else {
+				str = f.First.Format(c.Format)
+			}
+		case "end":
+			if !f.window.IsZero() {
+				str = f.window.Add(interval).Format(c.Format)
+			} else {
+				str = f.Last.Format(c.Format)
+			}
+		case "part":
+			str = fmt.Sprintf(c.Format, f.index)
+		default:
+			v, ok := f.values[c.Name]
+			if !ok {
+				str = "none"
+			} else if c.Format != "" {
+				str = fmt.Sprintf(c.Format, v)
+			} else {
+				str = fmt.Sprint(v)
+			}
+		}
+		buf.WriteString(cleanName(str))
+	}
+	return buf.String()
+}
+
+func cleanName(str string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ' ', '\t', ':':
+			return '_'
+		default:
+			return r
+		}
+	}, str)
+}
+
+// Size is a number of bytes given with an optional K, M or G suffix.
+type Size int64
+
+func (s *Size) Set(v string) error {
+	var (
+		str  = strings.ToUpper(strings.TrimSpace(v))
+		mult int64
+	)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		mult = 1 << 30
+	default:
+		mult = 1
+	}
+	if mult > 1 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %s", v)
+	}
+	*s = Size(n * mult)
+	return nil
+}
+
+func (s *Size) String() string {
+	return "size"
+}
+
+func runCat(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		filter Filter
+		errs   Errors
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&filter, "w", "filter expression")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	file := cmd.Flag.String("o", "", "output file")
+	sorted := cmd.Flag.Bool("s", false, "sort packets")
+	uniq := cmd.Flag.Bool("u", false, "no duplicate")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	var w io.WriteCloser = os.Stdout
+	if *file != "" && *file != "-" {
+		var err error
+		if w, err = CreateFile(*file); err != nil {
+			return err
+		}
+	}
+	defer w.Close()
+
+	var (
+		count, dups int
+		err         error
+	)
+	if *sorted {
+		count, dups, err = catSorted(w, cmd.Flag.Args(), kind, &filter, *uniq, errs.Handle)
+	} else {
+		count, dups, err = catFiles(w, cmd.Flag.Args(), kind, &filter, *uniq, errs.Handle)
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	log.Printf("%d packets written, %d duplicates skipped", count, dups)
+	errs.Summary()
+	return errs.Err()
+}
+
+// catFiles writes the packets of files in the order they are read. Duplicates
+// are packets with the same id, sequence counter and timestamp.
+func catFiles(w io.Writer, files []string, k Kind, f *Filter, uniq bool, fn ErrorHandler) (int, int, error) {
+	var (
+		count, dups int
+		seen        = make(map[indexKey]struct{})
+	)
+	for p := range WalkTraced(files, DecodeByFilter(f, k.Decod), fn) {
+		if uniq {
+			id, _ := p.Id()
+			key := indexKey{Id: id, Sequence: p.Sequence(), When: p.Timestamp().UnixNano()}
+			if _, ok := seen[key]; ok {
+				dups++
+				continue
+			}
+			seen[key] = struct{}{}
+		}
+		if _, err := w.Write(p.Bytes()); err != nil {
+			return count, dups, err
+		}
+		count++
+	}
+	return count, dups, nil
+}
+
+// catSorted collects the packets of files in a temporary file before sorting
+// them with the sort function of their type.
+func catSorted(w io.Writer, files []string, k Kind, f *Filter, uniq bool, fn ErrorHandler) (int, int, error) {
+	tmp, err := ioutil.TempFile("", ".meex-cat-")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	total, _, err := catFiles(tmp, files, k, f, false, fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	var r io.Reader
+	if uniq {
+		r, err = MergeWith(k.Decod, k.Sort, tmp)
+	} else {
+		r, err = SortWith(tmp, k.Decod, k.Sort)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		cw = packetWriter{Writer: w}
+		// hide ReadFrom so that io.CopyBuffer really uses the buffer
+		ws = struct{ io.Writer }{&cw}
+	)
+	if _, err := io.CopyBuffer(ws, r, make([]byte, MaxBufferSize)); err != nil {
+		return 0, 0, err
+	}
+	return cw.count, total - cw.count, nil
+}
+
+// packetWriter counts the writes of sorted readers, each giving one packet.
+type packetWriter struct {
+	io.Writer
+	count int
+}
+
+func (w *packetWriter) Write(bs []byte) (int, error) {
+	n, err := w.Writer.Write(bs)
+	if err == nil {
+		w.count++
+	}
+	return n, err
+}
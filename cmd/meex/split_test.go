@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTemplate(t *testing.T) {
+	var (
+		first = time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+		part  = splitPart{
+			key:    "1001",
+			index:  3,
+			values: map[string]interface{}{"apid": int64(1001)},
+		}
+	)
+	part.First, part.Last = first, first.Add(90*time.Second)
+
+	data := []struct {
+		Template string
+		Dir      string
+		Want     string
+		Fail     bool
+	}{
+		{Template: "out/{kind}_{part}.dat", Dir: "out", Want: "out/tm_0003.dat"},
+		{Template: "out/{key}/{start}.dat", Dir: "out", Want: "out/1001/20190301T100000.dat"},
+		{Template: "{start:150405}-{end:150405}.dat", Dir: ".", Want: "100000-100130.dat"},
+		{Template: "out/{APID:%04x}.dat", Dir: "out", Want: "out/03e9.dat"},
+		{Template: "out/{ apid }.dat", Dir: "out", Want: "out/1001.dat"},
+		{Template: "out/{channel}.dat", Dir: "out", Want: "out/none.dat"},
+		{Template: "out/{part:%d}", Dir: "out", Want: "out/3"},
+		{Template: "out/all.dat", Dir: "out", Want: "out/all.dat"},
+		{Template: "out/{kind", Fail: true},
+		{Template: "out/{unknown}.dat", Fail: true},
+	}
+	for _, d := range data {
+		tpl, err := ParseTemplate(d.Template)
+		if d.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error", d.Template)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Template, err)
+			continue
+		}
+		if got := tpl.Dir(); got != d.Dir {
+			t.Errorf("%s: want dir %s, got %s", d.Template, d.Dir, got)
+		}
+		if got := tpl.Render("tm", 0, &part); got != d.Want {
+			t.Errorf("%s: want %s, got %s", d.Template, d.Want, got)
+		}
+	}
+}
+
+func TestSizeSet(t *testing.T) {
+	data := []struct {
+		Value string
+		Want  Size
+		Fail  bool
+	}{
+		{Value: "0", Want: 0},
+		{Value: "512", Want: 512},
+		{Value: "4k", Want: 4 << 10},
+		{Value: "4K", Want: 4 << 10},
+		{Value: " 64M ", Want: 64 << 20},
+		{Value: "2G", Want: 2 << 30},
+		{Value: "", Fail: true},
+		{Value: "M", Fail: true},
+		{Value: "-1K", Fail: true},
+		{Value: "1.5M", Fail: true},
+		{Value: "10T", Fail: true},
+	}
+	for _, d := range data {
+		var s Size
+		err := s.Set(d.Value)
+		if d.Fail {
+			if err == nil {
+				t.Errorf("%q: expected error", d.Value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Value, err)
+			continue
+		}
+		if s != d.Want {
+			t.Errorf("%q: want %d, got %d", d.Value, d.Want, s)
+		}
+	}
+}
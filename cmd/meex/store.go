@@ -1,27 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/busoc/timutil"
 	"github.com/midbel/cli"
+	"golang.org/x/sync/errgroup"
 )
 
 type buffer struct {
-	datadir string
-	write   func([]byte) ([]byte, error)
+	datadir  string
+	compress string
+	kind     Kind
+	metrics  *Metrics
 
+	mu   sync.Mutex
 	file *os.File
 	tick <-chan time.Time
+
+	// compressing tracks the files of the previous intervals being compressed.
+	compressing sync.WaitGroup
 }
 
-func NewBuffer(dir string, i time.Duration, f func([]byte) ([]byte, error)) (io.WriteCloser, error) {
+func NewBuffer(dir string, i time.Duration, z Compress, k Kind, m *Metrics) (io.WriteCloser, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
@@ -29,11 +40,14 @@ func NewBuffer(dir string, i time.Duration, f func([]byte) ([]byte, error)) (io.
 	if err != nil {
 		return nil, err
 	}
+	m.Rotated(w.Name())
 	return &buffer{
-		datadir: dir,
-		write:   f,
-		tick:    time.Tick(i),
-		file:    w,
+		datadir:  dir,
+		compress: string(z),
+		kind:     k,
+		metrics:  m,
+		tick:     time.Tick(i),
+		file:     w,
 	}, nil
 }
 
@@ -42,94 +56,266 @@ func createFile(dir string) (*os.File, error) {
 	return os.Create(filepath.Join(dir, n))
 }
 
+// Write writes data whose packet has not been decoded yet. It is only decoded
+// when metrics are collected.
 func (b *buffer) Write(bs []byte) (int, error) {
+	var (
+		p   Packet
+		err error
+	)
+	if b.metrics != nil {
+		p, err = decodeDatagram(b.kind, bs)
+	}
+	return b.WritePacket(bs, p, err)
+}
+
+func (b *buffer) WritePacket(bs []byte, p Packet, perr error) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The tick is only polled: without the default case, every write would
+	// wait for the next rotation before being written.
 	select {
 	case <-b.tick:
-		b.file.Close()
+		b.rotate()
 		f, err := createFile(b.datadir)
 		if err != nil {
+			b.metrics.WriteError()
 			return 0, err
 		}
 		b.file = f
+		b.metrics.Rotated(f.Name())
+	default:
 	}
-	vs, err := b.write(bs)
+	b.metrics.Received(len(bs))
+	vs, err := b.kind.Frame(bs)
 	if err != nil {
+		b.metrics.FrameError()
 		return 0, err
 	}
 	if n, err := b.file.Write(vs); err != nil {
+		b.metrics.WriteError()
 		return n, err
 	}
+	b.metrics.Written(len(vs), p, perr)
 	return len(bs), nil
 }
 
+// Close closes the current file and waits for the compression of every file
+// rotated before it.
 func (b *buffer) Close() error {
-	if b.file != nil {
-		b.file.Close()
-		b.file = nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file == nil {
+		return nil
 	}
-	return nil
+	defer func() { b.file = nil }()
+	defer b.compressing.Wait()
+	if err := b.file.Close(); err != nil || b.compress == "" {
+		return err
+	}
+	return CompressFile(b.file.Name(), b.compress)
+}
+
+func (b *buffer) rotate() {
+	b.file.Close()
+	if b.compress == "" {
+		return
+	}
+	b.compressing.Add(1)
+	go func(file string) {
+		defer b.compressing.Done()
+		if err := CompressFile(file, b.compress); err != nil {
+			log.Printf("fail to compress %s: %s", file, err)
+		}
+	}(b.file.Name())
 }
 
 var storeCommand = &cli.Command{
-	Usage: "store [-k type] [-d datadir] [-i interval] [-p protocol] <addr>",
+	Usage: "store [-k type] [-d datadir] [-i interval] [-z compression] [-p protocol] [-iface name] [-rcvbuf size] [-size max-size] [-report interval] [-source-port] [-forward url] [-m metrics-addr] [-stale duration] [-listener name] <addr...>",
 	Short: "listen and store incoming packets in rt.dat files",
 	Run:   runStore,
 }
 
+const (
+	DefaultDatagramSize = 64 << 10
+	DefaultReport       = time.Minute
+)
+
 func runStore(cmd *cli.Command, args []string) error {
-	kind := cmd.Flag.String("k", "", "packet type")
-	datadir := cmd.Flag.String("d", os.TempDir(), "data directory")
+	var (
+		z    Compress
+		kind Kind
+		opts udpOptions
+		fwd  Forwarders
+	)
+	cmd.Flag.Var(&z, "z", "compress files on rotation (gz, zst, xz)")
+	cmd.Flag.Var(&kind, "k", "packet type")
+	datadir := cmd.Flag.String("d", "", "data directory")
 	proto := cmd.Flag.String("p", "udp", "protocol")
 	interval := cmd.Flag.Duration("i", Five, "interval")
-	if err := cmd.Flag.Parse(args); err != nil {
+	maddr := cmd.Flag.String("m", "", "metrics and health listening address")
+	stale := cmd.Flag.Duration("stale", 0, "report unhealthy when no packet received since duration")
+	cmd.Flag.StringVar(&opts.Iface, "iface", "", "network interface used to join multicast groups")
+	cmd.Flag.IntVar(&opts.Buffer, "rcvbuf", 0, "size of the socket receive buffer")
+	cmd.Flag.IntVar(&opts.Size, "size", DefaultDatagramSize, "maximum size of packets")
+	cmd.Flag.DurationVar(&opts.Report, "report", DefaultReport, "interval between reports of sources statistics")
+	cmd.Flag.BoolVar(&opts.Port, "source-port", false, "identify sources by address and port instead of address only")
+	cmd.Flag.Var(&fwd, "forward", "forward packets to destination (udp://addr or tcp://addr)")
+	cmd.Flag.String("listener", "", "listener defined in configuration file")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
-	var writeFunc func([]byte) ([]byte, error)
-	switch *kind {
-	case "tm", "pt", "pth":
-		writeFunc = storePTH
-	case "pp", "pdh", "pd":
-		writeFunc = storePDH
-	case "vmu":
-		writeFunc = storeVMU
+	if *datadir == "" {
+		return ErrNoDatadir
 	}
-	w, err := NewBuffer(*datadir, *interval, writeFunc)
+	if kind.Frame == nil {
+		return fmt.Errorf("packets of type %q can not be stored", kind.Name)
+	}
+	if cmd.Flag.NArg() == 0 {
+		return fmt.Errorf("no address to listen on")
+	}
+	var m *Metrics
+	if *maddr != "" {
+		m = NewMetrics(kind, *stale)
+		go func() {
+			if err := http.ListenAndServe(*maddr, m.Handler()); err != nil {
+				log.Printf("metrics: %s", err)
+			}
+		}()
+	}
+	wc, err := NewBuffer(*datadir, *interval, z, kind, m)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	defer wc.Close()
 
+	var (
+		group errgroup.Group
+		s     = NewSources(kind, m, opts.Port)
+		w     = Relay(wc, kind, fwd, m)
+	)
+	defer fwd.Close()
+	if opts.Report > 0 {
+		go func() {
+			for range time.Tick(opts.Report) {
+				s.Report()
+				if r, ok := w.(*relay); ok {
+					r.Report()
+				}
+			}
+		}()
+	}
 	switch *proto {
 	case "udp":
-		return copyUDP(cmd.Flag.Arg(0), w)
+		for _, a := range cmd.Flag.Args() {
+			a := a
+			group.Go(func() error {
+				return copyUDP(a, w, opts, s)
+			})
+		}
 	case "tcp":
-		return copyTCP(cmd.Flag.Arg(0), w)
+		for _, a := range cmd.Flag.Args() {
+			a := a
+			group.Go(func() error {
+				return copyTCP(a, w, kind, opts.Size, m)
+			})
+		}
 	default:
 		return fmt.Errorf("unsupported protocol %q", *proto)
 	}
+	return group.Wait()
+}
+
+type udpOptions struct {
+	Iface  string
+	Buffer int
+	Size   int
+	Report time.Duration
+	Port   bool
 }
 
-func copyUDP(addr string, w io.Writer) error {
+func listenUDP(addr string, opts udpOptions) (*net.UDPConn, error) {
 	a, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var ifi *net.Interface
+	if opts.Iface != "" {
+		if ifi, err = net.InterfaceByName(opts.Iface); err != nil {
+			return nil, err
+		}
 	}
 	var c *net.UDPConn
 	if a.IP.IsMulticast() {
-		c, err = net.ListenMulticastUDP("udp", nil, a)
+		c, err = net.ListenMulticastUDP("udp", ifi, a)
 	} else {
 		c, err = net.ListenUDP("udp", a)
 	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Buffer > 0 {
+		if err := c.SetReadBuffer(opts.Buffer); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// copyUDP writes each datagram received on addr to w. Datagrams larger than
+// the maximum size are dropped: one byte more than the maximum is read to
+// detect them since the kernel silently truncates datagrams that do not fit
+// in the buffer. Datagrams are decoded once and their packet is given to w
+// and to the sources statistics.
+func copyUDP(addr string, w io.Writer, opts udpOptions, s *Sources) error {
+	c, err := listenUDP(addr, opts)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	_, err = io.Copy(w, c)
-	return err
+	if opts.Size <= 0 {
+		opts.Size = DefaultDatagramSize
+	}
+	buf := make([]byte, opts.Size+1)
+	for {
+		n, src, err := c.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if n > opts.Size {
+			s.Oversized(addr, src)
+			continue
+		}
+		p, perr := decodeDatagram(s.kind, buf[:n])
+		if _, err := writePacket(w, buf[:n], p, perr); err != nil {
+			return err
+		}
+		s.Update(addr, src, buf[:n], p, perr)
+	}
+}
+
+// PacketWriter is implemented by the writers of store that use the packet
+// decoded from the data written. The packet is nil when the data can not be
+// decoded and perr gives the reason.
+type PacketWriter interface {
+	WritePacket(bs []byte, p Packet, perr error) (int, error)
 }
 
-func copyTCP(addr string, w io.Writer) error {
+func writePacket(w io.Writer, bs []byte, p Packet, perr error) (int, error) {
+	if pw, ok := w.(PacketWriter); ok {
+		return pw.WritePacket(bs, p, perr)
+	}
+	return w.Write(bs)
+}
+
+// copyTCP writes the packets received on the connections accepted on addr.
+// Unlike datagrams, packets sent over TCP are preceded by their size as a 4
+// bytes little endian integer so that they can be read whole from the stream.
+func copyTCP(addr string, w io.Writer, k Kind, size int, m *Metrics) error {
 	c, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
@@ -140,13 +326,46 @@ func copyTCP(addr string, w io.Writer) error {
 		if err != nil {
 			return err
 		}
+		m.Connect()
 		go func(c net.Conn) {
-			defer c.Close()
-			io.Copy(w, c)
+			defer func() {
+				c.Close()
+				m.Disconnect()
+			}()
+			if err := copyRecords(w, c, k, size); err != nil {
+				log.Printf("%s: %s", c.RemoteAddr(), err)
+			}
 		}(c)
 	}
 }
 
+func copyRecords(w io.Writer, r io.Reader, k Kind, size int) error {
+	var (
+		rs  = bufio.NewReader(r)
+		buf = make([]byte, size)
+		hdr [4]byte
+	)
+	for {
+		if _, err := io.ReadFull(rs, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := int(binary.LittleEndian.Uint32(hdr[:]))
+		if n > size {
+			return fmt.Errorf("packet too large (%d bytes)", n)
+		}
+		if _, err := io.ReadFull(rs, buf[:n]); err != nil {
+			return err
+		}
+		p, perr := decodeDatagram(k, buf[:n])
+		if _, err := writePacket(w, buf[:n], p, perr); err != nil {
+			return err
+		}
+	}
+}
+
 func storePTH(bs []byte) ([]byte, error) {
 	vs := make([]byte, len(bs)+10)
 	binary.LittleEndian.PutUint32(vs, uint32(len(bs))+6)
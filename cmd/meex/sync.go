@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+	"github.com/midbel/xxh"
+)
+
+var syncCommand = &cli.Command{
+	Usage: "sync [-k type] [-n dry-run] [-c conflicts] [-q quiet] [-strict] <source> <target>",
+	Short: "merge packets missing from a target archive with the ones of a source archive",
+	Run:   runSync,
+}
+
+const (
+	SyncIdentical = "identical"
+	SyncCopied    = "copied"
+	SyncMerged    = "merged"
+)
+
+// SyncFile is the result of the comparison of a file available in the source
+// archive with the same file in the target archive. Packets are matched on
+// their id, sequence counter and timestamp and compared with their xxh64
+// digest; records that can not be decoded are matched on their digest.
+// Conflicts are packets with the same key but different content: the
+// packet of the target is always kept.
+type SyncFile struct {
+	File      string
+	Source    int
+	Target    int
+	Missing   int
+	Conflicts []SyncConflict
+	Status    string
+}
+
+type SyncConflict struct {
+	Id        int
+	Sequence  int
+	Timestamp time.Time
+
+	Source       Provenance
+	Target       Provenance
+	SourceDigest uint64
+	TargetDigest uint64
+}
+
+func runSync(cmd *cli.Command, args []string) error {
+	var (
+		kind Kind
+		errs Errors
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.BoolVar(&errs.Strict, "strict", false, "stop at first error")
+	dry := cmd.Flag.Bool("n", false, "report differences without updating target")
+	conflicts := cmd.Flag.String("c", "", "write conflicts to file")
+	quiet := cmd.Flag.Bool("q", false, "quiet")
+	if err := parseArgs(cmd, args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		return fmt.Errorf("no packet type provided")
+	}
+	if cmd.Flag.NArg() != 2 {
+		return fmt.Errorf("source and target archives expected")
+	}
+	source, target := cmd.Flag.Arg(0), cmd.Flag.Arg(1)
+
+	var cw *csv.Writer
+	if *conflicts != "" {
+		f, err := os.Create(*conflicts)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cw = csv.NewWriter(f)
+		cw.Write([]string{"file", "id", "sequence", "dtstamp", "source", "target", "source-digest", "target-digest"})
+		defer cw.Flush()
+	}
+
+	const row = "%-32s | %8d | %8d | %8d | %6d | %s"
+	var (
+		files, merged, missing, conflicted int
+		now                                = time.Now()
+		buffer                             = make([]byte, MaxBufferSize)
+	)
+	err := filepath.Walk(source, func(p string, i os.FileInfo, err error) error {
+		if err != nil || !i.Mode().IsRegular() || strings.HasPrefix(i.Name(), ".") {
+			return err
+		}
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		s, err := SyncFiles(p, filepath.Join(target, rel), kind, *dry, buffer)
+		if err != nil {
+			return errs.Handle(fmt.Errorf("%s: %s", rel, err))
+		}
+		files++
+		missing += s.Missing
+		conflicted += len(s.Conflicts)
+		if s.Status != SyncIdentical {
+			merged++
+		}
+		if !*quiet && (s.Status != SyncIdentical || len(s.Conflicts) > 0) {
+			log.Printf(row, rel, s.Source, s.Target, s.Missing, len(s.Conflicts), s.Status)
+		}
+		if cw != nil {
+			for _, c := range s.Conflicts {
+				cw.Write([]string{
+					rel,
+					strconv.Itoa(c.Id),
+					strconv.Itoa(c.Sequence),
+					c.Timestamp.Format(time.RFC3339Nano),
+					c.Source.String(),
+					c.Target.String(),
+					fmt.Sprintf("%016x", c.SourceDigest),
+					fmt.Sprintf("%016x", c.TargetDigest),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%d files compared, %d updated, %d packets missing, %d conflicts (%s)", files, merged, missing, conflicted, time.Since(now))
+	errs.Summary()
+	return errs.Err()
+}
+
+// SyncFiles merges the packets of source missing from target. A target file is
+// looked for with any of the supported compression extensions. The target is
+// left untouched when dry is set or when one of the files is truncated.
+func SyncFiles(source, target string, k Kind, dry bool, buffer []byte) (*SyncFile, error) {
+	s := SyncFile{File: target}
+
+	file := findCompressed(target)
+	if file == "" {
+		ps, err := digestFile(source, k.Decod)
+		if err != nil {
+			return nil, err
+		}
+		s.Source, s.Missing, s.Status = ps.Len(), ps.Len(), SyncCopied
+		if dry {
+			return &s, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		r, err := OpenFile(source)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return &s, writeFileAtomic(target, r, buffer)
+	}
+	s.File = file
+
+	src, err := digestFile(source, k.Decod)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := digestFile(file, k.Decod)
+	if err != nil {
+		return nil, err
+	}
+	s.Source, s.Target = src.Len(), dst.Len()
+	for sum := range src.raws {
+		if _, ok := dst.raws[sum]; !ok {
+			s.Missing++
+		}
+	}
+	for _, key := range src.order {
+		sp := src.packets[key]
+		tp, ok := dst.packets[key]
+		if !ok {
+			s.Missing++
+			continue
+		}
+		if sp.Digest != tp.Digest {
+			s.Conflicts = append(s.Conflicts, SyncConflict{
+				Id:           key.Id,
+				Sequence:     key.Sequence,
+				Timestamp:    time.Unix(0, key.When).UTC(),
+				Source:       sp.Provenance,
+				Target:       tp.Provenance,
+				SourceDigest: sp.Digest,
+				TargetDigest: tp.Digest,
+			})
+		}
+	}
+	if s.Missing == 0 {
+		s.Status = SyncIdentical
+		return &s, nil
+	}
+	s.Status = SyncMerged
+	if dry {
+		return &s, nil
+	}
+
+	tr, err := OpenSeeker(file)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+	sr, err := OpenSeeker(source)
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+
+	// MergeWith keeps every record of both files, including the ones that can
+	// not be decoded, and fails before anything is written if a file can not be
+	// read until its end.
+	mr, err := MergeWith(k.Decod, k.Sort, tr, sr)
+	if err != nil {
+		return nil, err
+	}
+	return &s, writeFileAtomic(file, mr, buffer)
+}
+
+type digestPacket struct {
+	Provenance
+	Digest uint64
+}
+
+// digestSet holds the digests of the packets of a file and of its records that
+// can not be decoded.
+type digestSet struct {
+	order   []indexKey
+	packets map[indexKey]digestPacket
+	raws    map[uint64]struct{}
+}
+
+func (d *digestSet) Len() int {
+	return len(d.order) + len(d.raws)
+}
+
+func digestFile(file string, d Decoder) (*digestSet, error) {
+	if isFramed(d) {
+		return nil, fmt.Errorf("packets of framed streams can not be synced")
+	}
+	r, err := OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ds := digestSet{
+		packets: make(map[indexKey]digestPacket),
+		raws:    make(map[uint64]struct{}),
+	}
+	err = readRecords(r, func(offset int, bs []byte) error {
+		sum := xxh.Sum64(bs, 0)
+		p, _ := d.Decode(bs)
+		if p == nil {
+			ds.raws[sum] = struct{}{}
+			return nil
+		}
+		id, _ := p.Id()
+		k := indexKey{
+			Id:       id,
+			Sequence: p.Sequence(),
+			When:     p.Timestamp().UnixNano(),
+		}
+		if _, ok := ds.packets[k]; ok {
+			return nil
+		}
+		ds.order = append(ds.order, k)
+		ds.packets[k] = digestPacket{
+			Provenance: Provenance{File: file, Offset: int64(offset)},
+			Digest:     sum,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &ds, nil
+}
+
+func findCompressed(file string) string {
+	base := TrimCompressExt(file)
+	for _, e := range append([]string{CompressExt(file), ""}, compressExts...) {
+		if i, err := os.Stat(base + e); err == nil && i.Mode().IsRegular() {
+			return base + e
+		}
+	}
+	return ""
+}
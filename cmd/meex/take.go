@@ -1,29 +1,34 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/midbel/cli"
 )
 
 var takeCommand = &cli.Command{
-	Usage: "take [-n parts] <source> <target>",
-	Alias: []string{"split"},
+	Usage: "take [-n parts] [-r ratio] [-k type] [-b key] [-seed seed] <source> <target>",
 	Short: "splits randomly packets from source file to target file(s) into a new file",
 	Run:   runTake,
 }
 
 var mixCommand = &cli.Command{
-	Usage: "mix [-s source] [-t target] [-u uniq] <file>",
+	Usage: "mix [-s source] [-t target] [-u uniq] [-seed seed] <file>",
 	Alias: []string{"blend"},
 	Short: "take two rt files and mix their packets randomly into a new one",
 	Run:   runMix,
 }
 
 var shuffleCommand = &cli.Command{
-	Usage: "shuffle [-k type] <source> <target>",
+	Usage: "shuffle [-k type] [-m displacement] [-seed seed] <source> <target>",
 	Short: "shuffle packets from RT files",
 	Run:   runShuffle,
 }
@@ -31,35 +36,40 @@ var shuffleCommand = &cli.Command{
 func runShuffle(cmd *cli.Command, args []string) error {
 	var kind Kind
 	cmd.Flag.Var(&kind, "k", "packet type")
-	if err := cmd.Flag.Parse(args); err != nil {
+	seed := cmd.Flag.Int64("seed", 0, "random seed")
+	window := cmd.Flag.Int("m", 0, "maximum displacement")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
-	source, err := os.Open(cmd.Flag.Arg(0))
+	source, err := OpenSeeker(cmd.Flag.Arg(0))
 	if err != nil {
 		return err
 	}
 	defer source.Close()
 
-	target, err := os.Create(cmd.Flag.Arg(1))
+	target, err := CreateFile(cmd.Flag.Arg(1))
 	if err != nil {
 		return err
 	}
 	defer target.Close()
 
-	s, err := Shuffle(source, kind.Decod)
+	s, err := Shuffle(source, kind.Decod, seedRand(*seed), *window)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.CopyBuffer(NoDuplicate(target), s, make([]byte, MaxBufferSize))
-	return err
+	if _, err := io.CopyBuffer(NoDuplicate(target), s, make([]byte, MaxBufferSize)); err != nil {
+		return err
+	}
+	return target.Close()
 }
 
 func runMix(cmd *cli.Command, args []string) error {
 	uniq := cmd.Flag.Bool("u", false, "no duplicate")
 	src := cmd.Flag.String("s", "", "source file")
 	dst := cmd.Flag.String("t", "", "target file")
-	if err := cmd.Flag.Parse(args); err != nil {
+	seed := cmd.Flag.Int64("seed", 0, "random seed")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
 	source, err := ScanFile(*src)
@@ -88,17 +98,48 @@ func runMix(cmd *cli.Command, args []string) error {
 	if *uniq {
 		ws = NoDuplicate(ws)
 	}
-	_, err = io.CopyBuffer(ws, MixReader(source, target), make([]byte, MaxBufferSize))
+	_, err = io.CopyBuffer(ws, MixReader(seedRand(*seed), source, target), make([]byte, MaxBufferSize))
 	return err
 }
 
 func runTake(cmd *cli.Command, args []string) error {
+	var (
+		kind  Kind
+		ratio Ratio
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&ratio, "r", "weights of parts")
 	parts := cmd.Flag.Int("n", 2, "parts")
-	if err := cmd.Flag.Parse(args); err != nil {
+	by := cmd.Flag.String("b", "", "split by key")
+	seed := cmd.Flag.Int64("seed", 0, "random seed")
+	if err := parseArgs(cmd, args); err != nil {
 		return err
 	}
+	if len(ratio) == 0 {
+		for i := 0; i < *parts; i++ {
+			ratio = append(ratio, 1)
+		}
+	}
+	var key func([]byte) string
+	if *by != "" {
+		if kind.Decod == nil {
+			return fmt.Errorf("packet type required to split by %s", *by)
+		}
+		f, err := lookupField(*by)
+		if err != nil {
+			return err
+		}
+		key = func(bs []byte) string {
+			p, err := kind.Decod.Decode(bs)
+			if err != nil {
+				return ""
+			}
+			v, _ := f.get(p)
+			return fmt.Sprint(v)
+		}
+	}
 
-	r, err := os.Open(cmd.Flag.Arg(0))
+	r, err := OpenFile(cmd.Flag.Arg(0))
 	if err != nil {
 		return err
 	}
@@ -109,7 +150,7 @@ func runTake(cmd *cli.Command, args []string) error {
 		file = filepath.Join(d, "meex.dat")
 	}
 
-	w, err := SplitWriter(file, *parts)
+	w, err := SplitWriter(file, ratio, key, seedRand(*seed))
 	if err != nil {
 		return err
 	}
@@ -123,3 +164,42 @@ func runTake(cmd *cli.Command, args []string) error {
 	}
 	return s.Err()
 }
+
+// seedRand gives a source of random numbers seeded with seed or with the
+// current time when seed is zero. The seed is always logged so that a dataset
+// can be generated again.
+func seedRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("seed: %d", seed)
+	return rand.New(rand.NewSource(seed))
+}
+
+// Ratio gives the weights of the parts created by take, either as a list of
+// weights (70,20,10 or 3:1) or as a single ratio (0.8 for 80/20).
+type Ratio []float64
+
+func (r *Ratio) Set(v string) error {
+	fs := strings.FieldsFunc(v, func(c rune) bool { return c == ',' || c == ':' })
+	vs := make([]float64, 0, len(fs))
+	for _, f := range fs {
+		w, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || w < 0 {
+			return fmt.Errorf("invalid weight %s", f)
+		}
+		vs = append(vs, w)
+	}
+	if len(vs) == 1 {
+		if vs[0] <= 0 || vs[0] >= 1 {
+			return fmt.Errorf("ratio should be between 0 and 1 (got %s)", v)
+		}
+		vs = append(vs, 1-vs[0])
+	}
+	*r = vs
+	return nil
+}
+
+func (r *Ratio) String() string {
+	return "weights of parts"
+}
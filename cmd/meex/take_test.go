@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRatioSet(t *testing.T) {
+	data := []struct {
+		Value string
+		Want  []float64
+		Fail  bool
+	}{
+		{Value: "70,20,10", Want: []float64{70, 20, 10}},
+		{Value: "3:1", Want: []float64{3, 1}},
+		{Value: " 1 , 1 ", Want: []float64{1, 1}},
+		{Value: "0.75", Want: []float64{0.75, 0.25}},
+		{Value: "1,0", Want: []float64{1, 0}},
+		{Value: "0", Fail: true},
+		{Value: "1", Fail: true},
+		{Value: "1.5", Fail: true},
+		{Value: "70,-20", Fail: true},
+		{Value: "70,abc", Fail: true},
+	}
+	for _, d := range data {
+		var r Ratio
+		err := r.Set(d.Value)
+		if d.Fail {
+			if err == nil {
+				t.Errorf("%q: expected error", d.Value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Value, err)
+			continue
+		}
+		if len(r) != len(d.Want) {
+			t.Errorf("%q: want %v, got %v", d.Value, d.Want, r)
+			continue
+		}
+		for i := range r {
+			if r[i] != d.Want[i] {
+				t.Errorf("%q: want %v, got %v", d.Value, d.Want, r)
+				break
+			}
+		}
+	}
+}
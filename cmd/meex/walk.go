@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -27,6 +29,19 @@ func ListPaths(dir string, fd, td time.Time) []string {
 	return ds
 }
 
+// existingPaths gives the hourly directories of dir covering the hours from fd
+// to td that exist.
+func existingPaths(dir string, fd, td time.Time) []string {
+	var ds []string
+	for fd = fd.Truncate(time.Hour); fd.Before(td); fd = fd.Add(time.Hour) {
+		d := timePath(dir, fd)
+		if i, err := os.Stat(d); err == nil && i.IsDir() {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
 func TimePath(dir string, t time.Time) (string, error) {
 	dir = timePath(dir, t)
 	if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
@@ -44,19 +59,53 @@ func timePath(dir string, t time.Time) string {
 	return filepath.Join(dir, year, doy, hour)
 }
 
+type Provenance struct {
+	File   string
+	Offset int64
+	Index  int
+}
+
+func (v Provenance) String() string {
+	return fmt.Sprintf("%s:%d", v.File, v.Offset)
+}
+
+type TracedPacket struct {
+	Packet
+	Provenance
+}
+
 func Walk(paths []string, d Decoder) <-chan Packet {
 	q := make(chan Packet)
+	go func() {
+		defer close(q)
+		for p := range WalkTraced(paths, d, nil) {
+			q <- p.Packet
+		}
+	}()
+	return q
+}
+
+func WalkTraced(paths []string, d Decoder, fn ErrorHandler) <-chan *TracedPacket {
+	return WalkContext(context.Background(), paths, d, fn)
+}
+
+// WalkContext is like WalkTraced but stops reading the files as soon as ctx is
+// done.
+func WalkContext(ctx context.Context, paths []string, d Decoder, fn ErrorHandler) <-chan *TracedPacket {
+	q := make(chan *TracedPacket)
 	go func() {
 		defer close(q)
 		if d == nil {
 			return
 		}
 		sort.Strings(paths)
+
+		var index int
 		for _, p := range paths {
 			if p == "" {
 				continue
 			}
-			if err := walk(p, q, d); err != nil {
+			if err := walk(ctx, p, &index, q, d, fn); err != nil {
 				return
 			}
 		}
@@ -67,22 +116,45 @@ func Walk(paths []string, d Decoder) <-chan Packet {
 type KeyGap struct {
 	*Gap
 	Key string
+
+	From Provenance
+	To   Provenance
+}
+
+func Gaps(paths []string, d Decoder, fn ErrorHandler) <-chan *KeyGap {
+	return GapsContext(context.Background(), paths, d, fn)
+}
+
+func GapsContext(ctx context.Context, paths []string, d Decoder, fn ErrorHandler) <-chan *KeyGap {
+	return GapsOf(ctx, WalkContext(ctx, paths, d, fn))
 }
 
-func Gaps(paths []string, d Decoder) <-chan *KeyGap {
+// GapsOf reports the gaps found between the packets received from queue.
+func GapsOf(ctx context.Context, queue <-chan *TracedPacket) <-chan *KeyGap {
 	q := make(chan *KeyGap)
 	go func() {
 		defer close(q)
 
-		gs := make(map[string]Packet)
-		for p := range Walk(paths, d) {
-			id := defaultPacketKey(p)
-			if g := p.Diff(gs[id]); g != nil {
+		gs := make(map[string]*TracedPacket)
+		for p := range queue {
+			id := defaultPacketKey(p.Packet)
+			prev, ok := gs[id]
+			if !ok {
+				gs[id] = p
+				continue
+			}
+			if g := p.Diff(prev.Packet); g != nil {
 				k := &KeyGap{
-					Key: id,
-					Gap: g,
+					Key:  id,
+					Gap:  g,
+					From: prev.Provenance,
+					To:   p.Provenance,
+				}
+				select {
+				case q <- k:
+				case <-ctx.Done():
+					return
 				}
-				q <- k
 			}
 			gs[id] = p
 		}
@@ -96,18 +168,27 @@ type KeyTimeCoze struct {
 	When time.Time
 }
 
-func CountByDay(paths []string, d Decoder) <-chan *KeyTimeCoze {
+func CountByDay(paths []string, d Decoder, fn ErrorHandler) <-chan *KeyTimeCoze {
+	return CountByDayContext(context.Background(), paths, d, fn)
+}
+
+func CountByDayContext(ctx context.Context, paths []string, d Decoder, fn ErrorHandler) <-chan *KeyTimeCoze {
 	q := make(chan *KeyTimeCoze)
 	go func() {
 		defer close(q)
 
 		gs := make(map[string]*KeyTimeCoze)
 		ps := make(map[string]Packet)
-		for p := range Walk(paths, d) {
+		for t := range WalkContext(ctx, paths, d, fn) {
+			p := t.Packet
 			id := defaultPacketKey(p)
 			c := gs[id]
 			if c != nil && p.Timestamp().Sub(c.When) >= Day {
-				q <- c
+				select {
+				case q <- c:
+				case <-ctx.Done():
+					return
+				}
 				delete(gs, id)
 			}
 			if _, ok := gs[id]; !ok {
@@ -129,7 +210,11 @@ func CountByDay(paths []string, d Decoder) <-chan *KeyTimeCoze {
 			ps[id], gs[id] = p, c
 		}
 		for _, c := range gs {
-			q <- c
+			select {
+			case q <- c:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	return q
@@ -146,47 +231,76 @@ func Infos(paths []string, d Decoder) <-chan *Info {
 	return q
 }
 
-func walk(p string, q chan Packet, d Decoder) error {
-	var rt *Reader
-	return filepath.Walk(p, func(p string, i os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if i.IsDir() {
-			return nil
-		}
-		r, err := os.Open(p)
-		if err != nil {
-			return err
-		}
-		defer r.Close()
-
+func walk(ctx context.Context, p string, index *int, q chan *TracedPacket, d Decoder, fn ErrorHandler) error {
+	var (
+		rt   *Reader
+		stop bool
+	)
+	err := WalkSources(p, func(file string, r io.Reader) error {
 		if rt == nil {
 			rt = NewReader(r, d)
 		} else {
 			rt.Reset(r)
 		}
+		defer func() { *index++ }()
 		// rt := NewReader(r, d)
-		for p := range rt.Packets() {
-			q <- p
+		for {
+			p, err := rt.Next()
+			switch err {
+			case nil:
+				t := &TracedPacket{
+					Packet: p,
+					Provenance: Provenance{
+						File:   file,
+						Offset: rt.Offset(),
+						Index:  *index,
+					},
+				}
+				select {
+				case q <- t:
+				case <-ctx.Done():
+					stop = true
+					return ctx.Err()
+				}
+				continue
+			case io.EOF:
+				return nil
+			case ErrSkip:
+				continue
+			}
+			e, ok := err.(*PacketError)
+			if ok {
+				e.File, e.Index = file, *index
+			} else {
+				err = fmt.Errorf("%s: %s", file, err)
+			}
+			if fn != nil {
+				if err := fn(err); err != nil {
+					stop = true
+					return err
+				}
+			}
+			if !ok {
+				return nil
+			}
 		}
-		return nil
 	})
+	if err == nil || stop || fn == nil {
+		return err
+	}
+	return fn(err)
 }
 
-func defaultPacketKey(p Packet) string {
-	switch p := p.(type) {
-	case *TMPacket:
-		return fmt.Sprint(p.CCSDS.Apid())
-	case *PDPacket:
-		return fmt.Sprintf("0x%x", p.UMI.Code[:])
-	case *VMUPacket:
-		return p.VMU.Channel.String()
-	case HRPacket:
-		i, _ := p.Id()
-		return fmt.Sprintf("%x/%s/%s", i, p.Type(), p.String())
+func streamLabel(p interface{}) string {
+	if _, ok := p.(Realtimer); !ok {
+		return "realtime"
+	}
+	switch rt, ok := streamOf(p); {
+	case !ok:
+		return "unknown"
+	case rt:
+		return "realtime"
 	default:
-		i, _ := p.Id()
-		return fmt.Sprint(i)
+		return "playback"
 	}
 }
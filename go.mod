@@ -0,0 +1,15 @@
+module github.com/alejandiaz/meex
+
+go 1.22
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/pkg/profile v1.7.0
+	github.com/ulikunitz/xz v0.5.9
+	golang.org/x/sync v0.9.0
+)
+
+require (
+	github.com/felixge/fgprof v0.9.3 // indirect
+	github.com/google/pprof v0.0.0-20211214055906-6f57359322fd // indirect
+)